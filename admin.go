@@ -0,0 +1,370 @@
+package parspackip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// instances tracks every provisioned ParspackIPRange so the admin API can
+// report on them
+var instances = struct {
+	sync.Mutex
+	list []*ParspackIPRange
+}{}
+
+// registerInstance adds p to the set reported by the admin API
+func registerInstance(p *ParspackIPRange) {
+	instances.Lock()
+	defer instances.Unlock()
+	instances.list = append(instances.list, p)
+}
+
+// unregisterInstance removes p from the set reported by the admin API
+func unregisterInstance(p *ParspackIPRange) {
+	instances.Lock()
+	defer instances.Unlock()
+	for i, inst := range instances.list {
+		if inst == p {
+			instances.list = append(instances.list[:i], instances.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// findInstance returns the most recently provisioned instance whose url is
+// rawURL, or the most recently provisioned one if rawURL is empty
+func findInstance(rawURL string) *ParspackIPRange {
+	instances.Lock()
+	defer instances.Unlock()
+	for i := len(instances.list) - 1; i >= 0; i-- {
+		if p := instances.list[i]; rawURL == "" || strings.EqualFold(p.URL, rawURL) {
+			return p
+		}
+	}
+	return nil
+}
+
+// instanceStatus is the admin API representation of a single instance
+type instanceStatus struct {
+	URL       string     `json:"url"`
+	Count     int        `json:"count"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Ready     bool       `json:"ready"`
+
+	// ListVersion is the version the list publishes in its header
+	// comments, like "# updated 2024-01-01"
+	ListVersion string `json:"list_version,omitempty"`
+
+	// Protocol is the HTTP version the list was last fetched over
+	Protocol string `json:"protocol,omitempty"`
+
+	ConsecutiveFailures int  `json:"consecutive_failures,omitempty"`
+	Stale               bool `json:"stale,omitempty"`
+	Paused              bool `json:"paused,omitempty"`
+
+	// PendingRemovals is the number of ranges missing from the list that
+	// are kept until confirm_changes confirms their removal
+	PendingRemovals int `json:"pending_removals,omitempty"`
+
+	// Sources maps each range, as listed by its source before exclusion
+	// and collapsing, to the URL or file it was fetched from, the hostname
+	// it was resolved from, or to "additional" or "cache"
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// additionalSource is the source tag of ranges configured with Additional
+const additionalSource = "additional"
+
+// status returns a snapshot of the instance's state
+func (p *ParspackIPRange) status() instanceStatus {
+	p = p.source()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	st := instanceStatus{
+		URL:   p.URL,
+		Count: len(p.ipRanges),
+		Ready: p.readyLocked(),
+
+		ListVersion: p.listVersion,
+		Protocol:    p.proto,
+
+		ConsecutiveFailures: p.failures,
+		Stale:               p.staleLocked(),
+		Paused:              p.paused,
+		PendingRemovals:     len(p.pending),
+	}
+	if len(p.sources)+len(p.merged)+len(p.additional)+len(p.fileIncludes)+len(p.resolved) > 0 {
+		st.Sources = make(map[string]string, len(p.sources)+len(p.additional)+len(p.resolved))
+		for prefix, source := range p.sources {
+			st.Sources[prefix.String()] = source
+		}
+		for _, m := range p.Merge {
+			for _, prefix := range p.merged[m.URL] {
+				if _, ok := st.Sources[prefix.String()]; !ok {
+					st.Sources[prefix.String()] = m.URL
+				}
+			}
+		}
+		for _, prefix := range p.additional {
+			if _, ok := st.Sources[prefix.String()]; !ok {
+				st.Sources[prefix.String()] = additionalSource
+			}
+		}
+		for _, path := range p.AdditionalFiles {
+			for _, prefix := range p.fileIncludes[path] {
+				if _, ok := st.Sources[prefix.String()]; !ok {
+					st.Sources[prefix.String()] = path
+				}
+			}
+		}
+		for prefix, host := range p.resolved {
+			if _, ok := st.Sources[prefix.String()]; !ok {
+				st.Sources[prefix.String()] = host
+			}
+		}
+	}
+	if !p.lastFetch.IsZero() {
+		lastFetch := p.lastFetch
+		st.LastFetch = &lastFetch
+	}
+	if p.lastErr != nil {
+		st.LastError = p.lastErr.Error()
+	}
+	return st
+}
+
+// adminAPI exposes the state of the ParsPack IP sources on the admin API
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.parspack",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/parspack/status",
+			Handler: caddy.AdminHandlerFunc(a.handleStatus),
+		},
+		{
+			Pattern: "/parspack/refresh",
+			Handler: caddy.AdminHandlerFunc(a.handleRefresh),
+		},
+		{
+			Pattern: "/parspack/pause",
+			Handler: caddy.AdminHandlerFunc(a.handlePause),
+		},
+		{
+			Pattern: "/parspack/resume",
+			Handler: caddy.AdminHandlerFunc(a.handleResume),
+		},
+		{
+			Pattern: "/parspack/ranges",
+			Handler: caddy.AdminHandlerFunc(a.handleRanges),
+		},
+	}
+}
+
+// handleStatus reports the last fetch time, range count and last error of
+// every instance
+func (adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	instances.Lock()
+	statuses := make([]instanceStatus, 0, len(instances.list))
+	for _, p := range instances.list {
+		statuses = append(statuses, p.status())
+	}
+	instances.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+// refreshResult is the admin API representation of a manual refresh
+type refreshResult struct {
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleRefresh synchronously refreshes every fetcher and reports the
+// resulting range counts. Instances sharing a fetcher are refreshed, and
+// reported, once.
+func (adminAPI) handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	instances.Lock()
+	list := append([]*ParspackIPRange(nil), instances.list...)
+	instances.Unlock()
+
+	results := make([]refreshResult, 0, len(list))
+	seen := make(map[*ParspackIPRange]bool, len(list))
+	failed := false
+	for _, p := range list {
+		src := p.source()
+		if seen[src] {
+			continue
+		}
+		seen[src] = true
+
+		var result refreshResult
+		if err := src.refresh(src.loopCtx); err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		st := src.status()
+		result.URL, result.Count = st.URL, st.Count
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return json.NewEncoder(w).Encode(results)
+}
+
+// handlePause stops the scheduled refreshes of every instance, which keep
+// serving their current ranges until resumed
+func (a adminAPI) handlePause(w http.ResponseWriter, r *http.Request) error {
+	return a.setPaused(w, r, true)
+}
+
+// handleResume restarts the scheduled refreshes of every instance
+func (a adminAPI) handleResume(w http.ResponseWriter, r *http.Request) error {
+	return a.setPaused(w, r, false)
+}
+
+// setPaused pauses or resumes every instance and reports their status
+func (adminAPI) setPaused(w http.ResponseWriter, r *http.Request, paused bool) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	instances.Lock()
+	statuses := make([]instanceStatus, 0, len(instances.list))
+	for _, p := range instances.list {
+		p.setPaused(paused)
+		statuses = append(statuses, p.status())
+	}
+	instances.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+// setPaused pauses or resumes the scheduled refreshes and hostname lookups
+// of the fetcher serving p
+func (p *ParspackIPRange) setPaused(paused bool) {
+	p = p.source()
+	p.mu.Lock()
+	changed := p.paused != paused
+	p.paused = paused
+	p.mu.Unlock()
+	if changed && paused {
+		p.log().Info("refreshing paused through the admin API")
+	} else if changed {
+		p.log().Info("refreshing resumed through the admin API")
+	}
+}
+
+// isPaused reports whether refreshing is paused
+func (p *ParspackIPRange) isPaused() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.paused
+}
+
+// instanceRanges is the admin API representation of the ranges served by
+// an instance
+type instanceRanges struct {
+	URL    string         `json:"url"`
+	Ranges []netip.Prefix `json:"ranges"`
+}
+
+// handleRanges lists the ranges currently served by every instance. With
+// a contains query parameter, only the ranges containing that address are
+// listed, and the response is a 404 if no instance trusts it.
+func (adminAPI) handleRanges(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var addr netip.Addr
+	filter := r.URL.Query().Has("contains")
+	if filter {
+		var err error
+		if addr, err = netip.ParseAddr(r.URL.Query().Get("contains")); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid contains address: %v", err),
+			}
+		}
+		addr = addr.Unmap()
+	}
+
+	instances.Lock()
+	list := append([]*ParspackIPRange(nil), instances.list...)
+	instances.Unlock()
+
+	results := make([]instanceRanges, 0, len(list))
+	found := false
+	for _, p := range list {
+		ranges := p.GetIPRanges(nil)
+		if filter {
+			ranges = slices.DeleteFunc(ranges, func(prefix netip.Prefix) bool { return !prefix.Contains(addr) })
+			found = found || len(ranges) > 0
+		}
+		results = append(results, instanceRanges{URL: p.source().URL, Ranges: ranges})
+	}
+	if filter && !found {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("%s is not in any range", addr),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,334 @@
+package parspackip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAdminStatus(t *testing.T) {
+	p := &ParspackIPRange{
+		URL:       ipv4URL,
+		ipRanges:  []netip.Prefix{netip.MustParsePrefix("185.8.172.0/22")},
+		lastFetch: time.Now(),
+		lastErr:   errors.New("boom"),
+	}
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/parspack/status", nil)
+	if err := (adminAPI{}).handleStatus(w, r); err != nil {
+		t.Fatalf("handleStatus() error = %v", err)
+	}
+
+	var statuses []instanceStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(statuses))
+	}
+	st := statuses[0]
+	if st.Count != 1 || st.URL != ipv4URL || st.LastFetch == nil || st.LastError != "boom" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ranges := []netip.Prefix{netip.MustParsePrefix("185.8.172.0/22")}
+	tests := []struct {
+		name string
+		p    *ParspackIPRange
+		want bool
+	}{
+		{name: "never fetched", p: &ParspackIPRange{Interval: caddy.Duration(time.Hour)}},
+		{name: "fresh", p: &ParspackIPRange{Interval: caddy.Duration(time.Hour), fetched: ranges, lastFetch: time.Now()}, want: true},
+		{name: "empty", p: &ParspackIPRange{Interval: caddy.Duration(time.Hour), lastFetch: time.Now()}},
+		{name: "stale", p: &ParspackIPRange{Interval: caddy.Duration(time.Hour), fetched: ranges, lastFetch: time.Now().Add(-4 * time.Hour)}},
+		{
+			name: "stale without refresh",
+			p:    &ParspackIPRange{Interval: caddy.Duration(time.Hour), DisableRefresh: true, fetched: ranges, lastFetch: time.Now().Add(-4 * time.Hour)},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.Ready(); got != tt.want {
+				t.Errorf("Ready() = %v, want %v", got, tt.want)
+			}
+			if got := tt.p.status().Ready; got != tt.want {
+				t.Errorf("status().Ready = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyAfter(t *testing.T) {
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+	p.MaxRetries = -1
+	p.Interval = caddy.Duration(time.Hour)
+	p.InitialRetry = caddy.Duration(time.Minute)
+	p.ReadyAfter = 3
+
+	now := time.Now()
+	due := now.Add(time.Hour)
+	for i, step := range []struct {
+		fail bool
+		want bool
+	}{
+		{want: false},
+		{want: false},
+		// The successes must be consecutive
+		{fail: true, want: false},
+		{want: false},
+		{want: false},
+		{want: true},
+		// Once ready, a failure doesn't start over
+		{fail: true, want: true},
+	} {
+		failing = step.fail
+		p.fetchIPRanges(context.Background())
+		if got := p.Ready(); got != step.want {
+			t.Errorf("fetch %d: Ready() = %v, want %v", i, got, step.want)
+		}
+		wantDue := now.Add(time.Minute)
+		if step.want {
+			wantDue = due
+		}
+		if got := p.readyDue(due, now); !got.Equal(wantDue) {
+			t.Errorf("fetch %d: readyDue() = %v, want %v", i, got, wantDue)
+		}
+	}
+}
+
+func TestStatusSources(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n10.1.0.0/16\n"))
+	}))
+	defer mirror.Close()
+	v6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("2a0e:1c80::/32\n"))
+	}))
+	defer v6.Close()
+
+	p := newTestSource()
+	p.URL = primary.URL
+	p.Fallbacks = []string{mirror.URL}
+	p.ipv6Endpoint = v6.URL
+	p.MaxRetries = -1
+	p.additional = prefixes("10.1.0.0/16", "192.168.0.0/16")
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+
+	want := map[string]string{
+		"185.8.172.0/22": mirror.URL,
+		"10.1.0.0/16":    mirror.URL,
+		"2a0e:1c80::/32": v6.URL,
+		"192.168.0.0/16": additionalSource,
+	}
+	if got := p.status().Sources; !maps.Equal(got, want) {
+		t.Errorf("status().Sources = %v, want %v", got, want)
+	}
+}
+
+func TestStatusListVersion(t *testing.T) {
+	body := "# updated 2024-01-01\n185.8.172.0/22\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	v6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("2a0e:1c80::/32\n"))
+	}))
+	defer v6.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.ipv6Endpoint = v6.URL
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	// The IPv6 list has no header, it must not clear the version
+	if got := p.status().ListVersion; got != "2024-01-01" {
+		t.Errorf("status().ListVersion = %q, want 2024-01-01", got)
+	}
+
+	body = "185.8.172.0/22\n"
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	if got := p.status().ListVersion; got != "" {
+		t.Errorf("status().ListVersion = %q after the header was dropped, want none", got)
+	}
+}
+
+func TestAdminStatusMethodNotAllowed(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/parspack/status", nil)
+	if err := (adminAPI{}).handleStatus(w, r); err == nil {
+		t.Error("expected error for POST request")
+	}
+}
+
+func TestAdminRefresh(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n195.248.240.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+	p.loopCtx = context.Background()
+	registerInstance(p)
+	defer unregisterInstance(p)
+	// An instance sharing the fetcher of p is refreshed and reported once
+	shared := newTestSource()
+	shared.shared = p
+	registerInstance(shared)
+	defer unregisterInstance(shared)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/parspack/refresh", nil)
+	if err := (adminAPI{}).handleRefresh(w, r); err != nil {
+		t.Fatalf("handleRefresh() error = %v", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	var results []refreshResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(results) != 1 || results[0].Count != 2 || results[0].Error != "" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want one per fetcher", got)
+	}
+}
+
+func TestAdminRefreshMethodNotAllowed(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/parspack/refresh", nil)
+	if err := (adminAPI{}).handleRefresh(w, r); err == nil {
+		t.Error("expected error for GET request")
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	p := newTestSource()
+	p.URL = ipv4URL
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	for _, tt := range []struct {
+		handler func(http.ResponseWriter, *http.Request) error
+		paused  bool
+	}{
+		{handler: (adminAPI{}).handlePause, paused: true},
+		{handler: (adminAPI{}).handleResume, paused: false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/parspack/pause", nil)
+		if err := tt.handler(w, r); err != nil {
+			t.Fatalf("handler error = %v", err)
+		}
+		var statuses []instanceStatus
+		if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if len(statuses) != 1 || statuses[0].Paused != tt.paused {
+			t.Errorf("statuses = %+v, want paused %v", statuses, tt.paused)
+		}
+		if p.isPaused() != tt.paused {
+			t.Errorf("isPaused() = %v, want %v", p.isPaused(), tt.paused)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/parspack/pause", nil)
+	if err := (adminAPI{}).handlePause(w, r); err == nil {
+		t.Error("expected error for GET request")
+	}
+}
+
+func TestAdminRanges(t *testing.T) {
+	p := &ParspackIPRange{
+		URL:      ipv4URL,
+		ipRanges: prefixes("185.8.172.0/22", "195.248.240.0/22", "2a0e:1c80::/29"),
+	}
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	tests := []struct {
+		query    string
+		want     []netip.Prefix
+		wantCode int
+	}{
+		{query: "", want: p.ipRanges},
+		{query: "?contains=185.8.173.10", want: prefixes("185.8.172.0/22")},
+		{query: "?contains=::ffff:195.248.240.1", want: prefixes("195.248.240.0/22")},
+		{query: "?contains=1.1.1.1", wantCode: http.StatusNotFound},
+		{query: "?contains=bogus", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/parspack/ranges"+tt.query, nil)
+			err := (adminAPI{}).handleRanges(w, r)
+			if tt.wantCode != 0 {
+				var apiErr caddy.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.wantCode {
+					t.Fatalf("handleRanges() error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleRanges() error = %v", err)
+			}
+			var results []instanceRanges
+			if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if len(results) != 1 || !slices.Equal(results[0].Ranges, tt.want) {
+				t.Errorf("results = %+v, want ranges %v", results, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package parspackip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// cacheSource is the source tag of ranges loaded from the cache file
+const cacheSource = "cache"
+
+// bootstrapSource is the source tag of ranges seeded from Bootstrap and
+// BootstrapFile
+const bootstrapSource = "bootstrap"
+
+// defaultCacheTTL is how old a cache file may be by default before it is
+// ignored on startup
+const defaultCacheTTL = 7 * 24 * time.Hour
+
+// loadCache seeds the IP ranges from the cache file, if one is configured
+// and not older than CacheTTL. An expired cache is never served, so the
+// instance stays empty and not ready until the first fetch succeeds.
+func (p *ParspackIPRange) loadCache() error {
+	if p.CacheFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(p.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if age := p.now().Sub(info.ModTime()); p.CacheTTL > 0 && age > time.Duration(p.CacheTTL) {
+		p.log().Warn("ignoring expired cache file, waiting for a fresh fetch",
+			zap.String("file", p.CacheFile),
+			zap.Duration("age", age),
+			zap.Duration("cache_ttl", time.Duration(p.CacheTTL)))
+		return nil
+	}
+
+	data, err := os.ReadFile(p.CacheFile)
+	if err != nil {
+		return err
+	}
+	ranges, err := p.parseIPRanges(string(data))
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.fetched = ranges
+	p.sources = p.tagSources(ranges, nil, cacheSource)
+	p.ipv6Ranges = ipv6Only(ranges)
+	p.rebuildLocked()
+	p.mu.Unlock()
+
+	p.log().Info("loaded IP ranges from cache",
+		zap.String("file", p.CacheFile),
+		zap.Int("count", len(ranges)))
+	return nil
+}
+
+// loadBootstrap seeds the IP ranges from Bootstrap and BootstrapFile when
+// nothing was loaded from the cache. Like cached ranges, they are served
+// until the first successful fetch replaces them, but don't make the
+// instance ready.
+func (p *ParspackIPRange) loadBootstrap() error {
+	if len(p.Bootstrap) == 0 && p.BootstrapFile == "" {
+		return nil
+	}
+	p.mu.RLock()
+	cached := len(p.fetched) > 0
+	p.mu.RUnlock()
+	if cached {
+		return nil
+	}
+
+	var ranges []netip.Prefix
+	for _, cidr := range p.Bootstrap {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap range %q: %v", cidr, err)
+		}
+		ranges = append(ranges, unmapPrefix(prefix))
+	}
+	if p.BootstrapFile != "" {
+		data, err := os.ReadFile(p.BootstrapFile)
+		if err != nil {
+			return fmt.Errorf("reading bootstrap file: %w", err)
+		}
+		fileRanges, err := p.parseIPRanges(string(data))
+		if err != nil {
+			return fmt.Errorf("parsing bootstrap file %s: %w", p.BootstrapFile, err)
+		}
+		ranges = append(ranges, fileRanges...)
+	}
+	p.mu.Lock()
+	p.fetched = ranges
+	p.sources = p.tagSources(ranges, nil, bootstrapSource)
+	p.ipv6Ranges = ipv6Only(ranges)
+	p.rebuildLocked()
+	p.mu.Unlock()
+
+	p.log().Info("loaded bootstrap IP ranges", zap.Int("count", len(ranges)))
+	return nil
+}
+
+// saveCache writes the IP ranges to the cache file. The file is written to
+// a temporary file first and renamed into place, so a crash mid-write never
+// leaves a truncated cache behind.
+func (p *ParspackIPRange) saveCache(ranges []netip.Prefix) error {
+	if p.CacheFile == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# ParsPack IP ranges cached at %s\n", p.now().UTC().Format(time.RFC3339))
+	for _, prefix := range ranges {
+		b.WriteString(prefix.String())
+		b.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.CacheFile), filepath.Base(p.CacheFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.CacheFile)
+}
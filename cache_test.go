@@ -0,0 +1,112 @@
+package parspackip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "parspack.txt")
+	ranges := []netip.Prefix{
+		netip.MustParsePrefix("185.8.172.0/22"),
+		netip.MustParsePrefix("2a0e:1c80::/32"),
+	}
+
+	p := &ParspackIPRange{CacheFile: file, logger: zap.NewNop()}
+	if err := p.saveCache(ranges); err != nil {
+		t.Fatalf("saveCache() error = %v", err)
+	}
+
+	loaded := &ParspackIPRange{CacheFile: file, logger: zap.NewNop()}
+	if err := loaded.loadCache(); err != nil {
+		t.Fatalf("loadCache() error = %v", err)
+	}
+	got := loaded.GetIPRanges(nil)
+	if len(got) != len(ranges) {
+		t.Fatalf("loaded %d ranges, want %d", len(got), len(ranges))
+	}
+	for i := range ranges {
+		if got[i] != ranges[i] {
+			t.Errorf("range %d = %s, want %s", i, got[i], ranges[i])
+		}
+	}
+	if len(loaded.ipv6Ranges) != 1 {
+		t.Errorf("loaded %d IPv6 ranges, want 1", len(loaded.ipv6Ranges))
+	}
+}
+
+func TestLoadCacheIgnoresStaleFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "parspack.txt")
+	if err := os.WriteFile(file, []byte("185.8.172.0/22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ParspackIPRange{CacheFile: file, CacheTTL: caddy.Duration(time.Hour), logger: zap.NewNop()}
+	if err := p.loadCache(); err != nil {
+		t.Fatalf("loadCache() error = %v", err)
+	}
+	if got := p.GetIPRanges(nil); len(got) != 0 {
+		t.Errorf("expected stale cache to be ignored, got %d ranges", len(got))
+	}
+}
+
+func TestLoadCacheMissingFile(t *testing.T) {
+	p := &ParspackIPRange{CacheFile: filepath.Join(t.TempDir(), "missing.txt"), logger: zap.NewNop()}
+	if err := p.loadCache(); err != nil {
+		t.Errorf("loadCache() error = %v, want nil for missing file", err)
+	}
+}
+
+func TestLoadBootstrap(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "baseline.txt")
+	if err := os.WriteFile(file, []byte("195.248.240.0/22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ParspackIPRange{
+		Bootstrap:     []string{"185.8.172.0/22"},
+		BootstrapFile: file,
+		logger:        zap.NewNop(),
+	}
+	if err := p.loadBootstrap(); err != nil {
+		t.Fatalf("loadBootstrap() error = %v", err)
+	}
+	if got, want := p.GetIPRanges(nil), prefixes("185.8.172.0/22", "195.248.240.0/22"); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if got := p.status().Sources["185.8.172.0/22"]; got != bootstrapSource {
+		t.Errorf("source = %q, want %q", got, bootstrapSource)
+	}
+	if p.Ready() {
+		t.Error("Ready() = true before any fetch")
+	}
+
+	// A loaded cache takes precedence
+	cached := &ParspackIPRange{
+		Bootstrap: []string{"185.8.172.0/22"},
+		fetched:   prefixes("2a0e:1c80::/32"),
+		logger:    zap.NewNop(),
+	}
+	if err := cached.loadBootstrap(); err != nil {
+		t.Fatalf("loadBootstrap() error = %v", err)
+	}
+	if got := cached.fetched; !slices.Equal(got, prefixes("2a0e:1c80::/32")) {
+		t.Errorf("fetched = %v, want the cached ranges", got)
+	}
+
+	p = &ParspackIPRange{BootstrapFile: filepath.Join(t.TempDir(), "missing.txt"), logger: zap.NewNop()}
+	if err := p.loadBootstrap(); err == nil {
+		t.Error("expected error for a missing bootstrap file")
+	}
+}
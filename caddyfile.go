@@ -1,27 +1,110 @@
 package parspackip
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	ipv4URL = "https://parspack.com/cdnips.txt"
+	ipv6URL = "https://parspack.com/cdnips6.txt"
+
+	defaultInterval = 1 * time.Hour
+	minInterval     = 1 * time.Minute
+	defaultTimeout  = 30 * time.Second
+
+	// Bounds of the interval derived from the caching headers with
+	// AutoInterval
+	defaultMinAutoInterval = 5 * time.Minute
+	defaultMaxAutoInterval = 24 * time.Hour
+
+	// trieThreshold is the number of collapsed ranges from which Contains
+	// uses a trie instead of a binary search
+	trieThreshold = 4096
+
+	// readyStaleFactor is the number of intervals after the last successful
+	// fetch during which the instance is still reported as ready
+	readyStaleFactor = 3
+
+	// Connections are kept for reuse by the next few requests of a
+	// refresh, not until the next refresh
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 4
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	// wakeCheckInterval is the longest the refresh loop sleeps before
+	// checking the wall clock again
+	wakeCheckInterval = 1 * time.Minute
+
+	// maxRetryAfter caps the delay honored from a Retry-After header, so
+	// that a bogus far-future date can't stop refreshing for days
+	maxRetryAfter = 6 * time.Hour
+
+	defaultMaxBodySize = 5 << 20
+
+	// maxLoggedChanges is the largest diff whose prefixes are logged at
+	// Info level after a refresh
+	maxLoggedChanges = 20
+
+	defaultMaxParseWarnings = 10
+
+	// defaultMaxRanges is far above the size of any real list
+	defaultMaxRanges = 100_000
+
+	// Address families accepted by Family
+	familyV4   = "v4"
+	familyV6   = "v6"
+	familyBoth = "both"
+
+	// Strategies accepted by RetryJitter
+	retryJitterNone  = "none"
+	retryJitterEqual = "equal"
+	retryJitterFull  = "full"
+
+	// Policies accepted by OnError
+	onErrorKeep  = "keep"
+	onErrorClear = "clear"
+
+	// List formats accepted by Format
+	formatAuto = "auto"
+	formatText = "text"
+	formatJSON = "json"
+
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 1 * time.Second
+	maxRetryBackoff     = 1 * time.Minute
 )
 
 func init() {
-	caddy.RegisterModule(ParspackIPRange{})
+	caddy.RegisterModule(new(ParspackIPRange))
 }
 
 // ParspackIPRange retrieves ParsPack CDN IP ranges from their official sources
@@ -29,17 +112,391 @@ type ParspackIPRange struct {
 	// Interval specifies how often to refresh the IP list
 	Interval caddy.Duration `json:"interval,omitempty"`
 
-	// Timeout specifies the maximum time to wait for a response
+	// Schedule refreshes the list at fixed times instead of every Interval,
+	// given as a daily HH:MM time or a five-field cron expression in local
+	// time. It cannot be combined with Interval.
+	Schedule string `json:"schedule,omitempty"`
+
+	// AutoInterval refreshes when the freshness lifetime the server returns
+	// through Cache-Control max-age or Expires runs out, clamped between
+	// MinInterval and MaxInterval. Interval is used while the list is
+	// served without caching headers.
+	AutoInterval bool `json:"auto_interval,omitempty"`
+
+	// MinInterval is the shortest time between two refreshes with
+	// AutoInterval (default 5m)
+	MinInterval caddy.Duration `json:"min_interval,omitempty"`
+
+	// MaxInterval is the longest time between two refreshes with
+	// AutoInterval (default 24h)
+	MaxInterval caddy.Duration `json:"max_interval,omitempty"`
+
+	// Timeout specifies the maximum time for a whole request, covering
+	// connecting, reading headers and reading the body (default 30s)
 	Timeout caddy.Duration `json:"timeout,omitempty"`
 
-	logger   *zap.Logger
-	ipRanges []netip.Prefix
-	mu       sync.RWMutex
-	stop     chan struct{}
+	// DisableRefresh loads the ranges once at startup and never refreshes
+	// them afterwards
+	DisableRefresh bool `json:"disable_refresh,omitempty"`
+
+	// StaticOnly serves the Additional ranges only, without any network
+	// access: nothing is fetched, read from disk or refreshed. Meant for
+	// hermetic tests of configs depending on this source.
+	StaticOnly bool `json:"static_only,omitempty"`
+
+	// RefreshSignal names a signal, SIGHUP, SIGUSR1 or SIGUSR2, that
+	// triggers an immediate refresh without reloading the config. Not
+	// available on Windows.
+	RefreshSignal string `json:"refresh_signal,omitempty"`
+
+	// InitialDelay postpones the first fetch after startup. It cannot be
+	// combined with WaitForFirstFetch.
+	InitialDelay caddy.Duration `json:"initial_delay,omitempty"`
+
+	// InitialRetry is the delay between attempts while no fetch has
+	// succeeded yet, used instead of Interval so that a server started
+	// during an outage gets its ranges soon after it ends
+	InitialRetry caddy.Duration `json:"initial_retry,omitempty"`
+
+	// ReadyAfter is the number of consecutive successful fetches required
+	// before the instance is ready, so that a single fetch of a partial
+	// list doesn't let traffic in. Until then, fetches are repeated after
+	// InitialRetry if it is set. Zero or one is ready after the first.
+	ReadyAfter int `json:"ready_after,omitempty"`
+
+	// Jitter adds a random delay of up to this duration to every refresh, so
+	// instances restarted together don't fetch at the same moment
+	Jitter caddy.Duration `json:"jitter,omitempty"`
+
+	// MaxRetries is the number of additional attempts made after a transient
+	// fetch failure (default 3, -1 disables retries). In the Caddyfile, 0
+	// disables retries as well.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// RetryBackoff is the initial delay between retries, doubled after each
+	// attempt up to one minute (default 1s)
+	RetryBackoff caddy.Duration `json:"retry_backoff,omitempty"`
+
+	// RetryJitter randomizes the delay between retries, so that instances
+	// failing together don't retry in lockstep: "full", the default, waits
+	// between zero and the backoff, "equal" between half the backoff and
+	// the backoff, and "none" exactly the backoff.
+	RetryJitter string `json:"retry_jitter,omitempty"`
+
+	// File reads the list from a local file instead of fetching it over
+	// HTTP. The file is re-read on every refresh.
+	File string `json:"file,omitempty"`
+
+	// URL overrides the ParsPack IPv4 list endpoint, e.g. for an internal mirror
+	URL string `json:"url,omitempty"`
+
+	// CacheFile is a path where fetched ranges are persisted, so they can be
+	// served immediately after a restart
+	CacheFile string `json:"cache_file,omitempty"`
+
+	// CacheTTL is how old the cache file may be to be loaded on startup
+	// (default 7 days). An older cache is ignored and the ranges stay empty
+	// until the first fetch succeeds.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// WaitForFirstFetch makes Provision block until the initial fetch
+	// completes and fail if it does not succeed. This delays server startup
+	// by up to Timeout per attempt.
+	WaitForFirstFetch bool `json:"wait_for_first_fetch,omitempty"`
+
+	// Additional lists extra CIDRs trusted alongside the fetched ranges.
+	// They are served even when fetching fails.
+	Additional []string `json:"additional,omitempty"`
+
+	// Exclude lists CIDRs removed from the served ranges, both fetched and
+	// additional. A range partially covered by an exclusion is split so
+	// that only the excluded part is dropped.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// AdditionalFiles are files of CIDRs, one per line, trusted like
+	// Additional. They are read again before every refresh, so that the
+	// overrides can be managed separately from the config. With StaticOnly
+	// or DisableRefresh, they are only read when the config is loaded.
+	AdditionalFiles []string `json:"additional_files,omitempty"`
+
+	// ExcludeFiles are files of CIDRs, one per line, removed like Exclude
+	// and read again before every refresh
+	ExcludeFiles []string `json:"exclude_files,omitempty"`
+
+	// Bootstrap lists CIDRs served from startup until the first successful
+	// fetch, when there is no usable cache file, so a cold start without
+	// network access never leaves the server trusting nothing. Unlike
+	// Additional, they are replaced by the fetched list.
+	Bootstrap []string `json:"bootstrap,omitempty"`
+
+	// BootstrapFile is a file of CIDRs, one per line, used like Bootstrap
+	BootstrapFile string `json:"bootstrap_file,omitempty"`
+
+	// Resolve lists hostnames whose A and AAAA records are trusted as well,
+	// as /32 and /128 prefixes. They are looked up again whenever their
+	// TTL expires, independently of Interval.
+	Resolve []string `json:"resolve,omitempty"`
+
+	// BasicAuth sets HTTP basic authentication credentials sent to the host
+	// of URL, for private mirrors. Placeholders such as {env.PASSWORD} are
+	// expanded.
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+
+	// BearerToken is sent as a bearer token to the host of URL, for private
+	// mirrors. Placeholders are expanded.
+	BearerToken string `json:"bearer_token,omitempty"`
+
+	// UserAgent overrides the User-Agent header sent when fetching
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// Method is the HTTP method used to request the lists from the host of
+	// URL, for mirrors behind gateways expecting a POST (default GET).
+	// Other hosts are always sent a GET. Conditional requests are only
+	// made with GET.
+	Method string `json:"method,omitempty"`
+
+	// Headers are extra request headers sent to the host of URL when
+	// fetching the lists and checksum, such as a gateway API key or a
+	// custom Accept. They replace the headers the module sets itself.
+	// Placeholders are expanded.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Proxy is an HTTP, HTTPS or SOCKS5 proxy URL used for fetching. When
+	// unset, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are honored.
+	Proxy string `json:"proxy,omitempty"`
+
+	// IdleConnTimeout is how long an idle connection is kept open for reuse
+	// (default 90s)
+	IdleConnTimeout caddy.Duration `json:"idle_conn_timeout,omitempty"`
+
+	// MaxIdleConns is the maximum number of idle connections kept open
+	// (default 4)
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+
+	// TLSHandshakeTimeout is the maximum time for a TLS handshake
+	// (default 10s)
+	TLSHandshakeTimeout caddy.Duration `json:"tls_handshake_timeout,omitempty"`
+
+	// HTTPVersion is the HTTP version used to fetch: "1.1" for mirrors or
+	// proxies mishandling HTTP/2, or "2" to require it, which needs every
+	// URL to be https. By default, HTTP/2 is negotiated over TLS and
+	// HTTP/1.1 used otherwise.
+	HTTPVersion string `json:"http_version,omitempty"`
+
+	// CAFile is a PEM file of CA certificates trusted when fetching over
+	// HTTPS, in addition to the system roots
+	CAFile string `json:"ca_file,omitempty"`
+
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key
+	// presented to mirrors that require client authentication. Both must be
+	// set together.
+	ClientCertFile string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  string `json:"client_key_file,omitempty"`
+
+	// InsecureSkipVerify disables verification of the server certificate.
+	// Only meant for testing; it lets anyone on the path forge the list.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// MaxBodySize is the maximum size in bytes of a downloaded list
+	// (default 5MiB)
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// Fallbacks are mirror URLs tried in order when fetching from URL fails
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// Gzip decompresses the lists served by URL and Fallbacks, for mirrors
+	// hosting them gzip-compressed as a static file rather than with a
+	// Content-Encoding. Lists whose URL ends in .gz are always decompressed.
+	Gzip bool `json:"gzip,omitempty"`
+
+	// Merge lists other providers' lists, fetched on every refresh and
+	// merged into the ranges. Unlike Fallbacks, all of them are used. A
+	// failing merged list keeps its previous ranges without failing the
+	// refresh. They are kept apart from the ParsPack ranges, so a failing
+	// ParsPack fetch doesn't affect them, and aren't passed to
+	// transformers.
+	Merge []MergeSource `json:"merge,omitempty"`
+
+	// MinRatio rejects a refresh whose range count drops below this fraction
+	// of the previous count, keeping the previous ranges instead. An empty
+	// list is always rejected. Zero disables the ratio check.
+	MinRatio float64 `json:"min_ratio,omitempty"`
+
+	// MaxRanges rejects a refresh returning more ranges than this, keeping
+	// the previous ranges instead (default 100000, -1 disables the limit)
+	MaxRanges int `json:"max_ranges,omitempty"`
+
+	// MinPrefixLen and MaxPrefixLen bound the prefix length of the IPv4
+	// ranges read from the lists, and MinPrefixLenIPv6 and MaxPrefixLenIPv6
+	// that of the IPv6 ones. Ranges outside the bounds are dropped and
+	// logged, so that a list publishing 0.0.0.0/0 by mistake doesn't trust
+	// the whole internet. Zero leaves a bound unset.
+	MinPrefixLen     int `json:"min_prefix_len,omitempty"`
+	MaxPrefixLen     int `json:"max_prefix_len,omitempty"`
+	MinPrefixLenIPv6 int `json:"min_prefix_len_ipv6,omitempty"`
+	MaxPrefixLenIPv6 int `json:"max_prefix_len_ipv6,omitempty"`
+
+	// DropPrivate drops and logs the ranges of the lists overlapping
+	// private, loopback, link-local or other reserved address blocks, so
+	// that internal addresses listed by mistake aren't trusted as the CDN.
+	// Additional ranges are kept.
+	DropPrivate bool `json:"drop_private,omitempty"`
+
+	// NotifyURL receives a POST with a JSON summary of each refresh: its
+	// status ("ok" or "error"), the range count, whether the ranges
+	// changed, a timestamp and the error, if any. It is sent in the
+	// background, with Timeout to answer.
+	NotifyURL string `json:"notify_url,omitempty"`
+
+	// NotifyOn selects the refreshes notified: "always", the default,
+	// "change" for those changing the ranges, or "error" for failed ones
+	NotifyOn string `json:"notify_on,omitempty"`
+
+	// ConfirmChanges delays the removal of a range until it has been
+	// missing from this many consecutive fetches, so that a list losing
+	// many ranges at once by mistake doesn't stop trusting them right away.
+	// Added ranges are trusted at once. Zero or one applies removals
+	// immediately.
+	ConfirmChanges int `json:"confirm_changes,omitempty"`
+
+	// Collapse drops ranges fully contained in another range and merges
+	// adjacent ones into the minimal set of prefixes, in addition to the
+	// exact duplicates that are always removed
+	Collapse bool `json:"collapse,omitempty"`
+
+	// ChecksumURL points to a file containing the SHA-256 of the IPv4 list,
+	// in hex as written by sha256sum. A list whose hash doesn't match is
+	// rejected and the previous ranges are kept.
+	ChecksumURL string `json:"checksum_url,omitempty"`
+
+	// Format is the format of the fetched list: "text" for one range per
+	// line, "json" for an object with "ipv4" and "ipv6" arrays of ranges,
+	// or "auto" (the default) to pick based on the response Content-Type,
+	// or on a .json extension for File.
+	Format string `json:"format,omitempty"`
+
+	// Strict rejects a list in which any line fails to parse, keeping the
+	// previous ranges. By default unparseable lines are skipped and the
+	// rest of the list is used.
+	Strict bool `json:"strict,omitempty"`
+
+	// MaxParseWarnings is the number of unparseable lines logged
+	// individually per fetch (default 10, -1 logs none, as does 0 in the
+	// Caddyfile). Lines beyond the cap are only counted in a single summary
+	// warning.
+	MaxParseWarnings int `json:"max_parse_warnings,omitempty"`
+
+	// FailureLogLevel is the level at which failed refreshes, initial,
+	// scheduled or signaled, are logged: "error", the default, "warn" or
+	// "debug". Lowering it avoids
+	// false alerts where the list is known to be unreachable at times.
+	FailureLogLevel string `json:"failure_log_level,omitempty"`
+
+	// MaxStale is how long every refresh may fail before the ranges are
+	// considered stale, which is logged as an error on each further
+	// failure. Zero disables the check.
+	MaxStale caddy.Duration `json:"max_stale,omitempty"`
+
+	// FailClosed clears the fetched ranges once they are stale, so that
+	// only additional and merged ranges remain trusted. By default the stale ranges
+	// keep being served.
+	FailClosed bool `json:"fail_closed,omitempty"`
+
+	// OnError is what a failed fetch does to the fetched ranges. With
+	// "keep", the default, they keep being served: the cached or bootstrap
+	// ones, if any, until the first fetch succeeds, then the last good set.
+	// With "clear", they are dropped at once, leaving only additional and
+	// merged ranges, so that clients aren't trusted on ranges that couldn't be
+	// confirmed.
+	OnError string `json:"on_error,omitempty"`
+
+	// IPv6 controls whether the IPv6 list is fetched as well (default true)
+	IPv6 *bool `json:"ipv6,omitempty"`
+
+	// Family restricts the served ranges, additional ones included, to an
+	// address family: "v4", "v6" or "both", the default. With "v4" the
+	// IPv6 list isn't fetched either.
+	Family string `json:"family,omitempty"`
+
+	// TransformersRaw are modules in the http.ip_sources.parspack.transformers
+	// namespace that post-process the fetched ranges, applied in order
+	TransformersRaw []json.RawMessage `json:"transformers,omitempty" caddy:"namespace=http.ip_sources.parspack.transformers inline_key=transformer"`
+
+	logger        *zap.Logger
+	ipRanges      []netip.Prefix
+	fetched       []netip.Prefix
+	sources       map[netip.Prefix]string
+	merged        map[string][]netip.Prefix
+	ipv6Ranges    []netip.Prefix
+	additional    []netip.Prefix
+	exclude       []netip.Prefix
+	fileIncludes  map[string][]netip.Prefix
+	fileExcludes  map[string][]netip.Prefix
+	resolved      map[netip.Prefix]string
+	lookup        []netip.Prefix
+	trie          *trie
+	mu            sync.RWMutex
+	cancel        context.CancelFunc
+	lastFetch     time.Time
+	modified      time.Time
+	lastErr       error
+	failures      int
+	successes     int
+	paused        bool
+	started       time.Time
+	validators    map[string]validators
+	pending       map[netip.Prefix]int
+	listVersion   string
+	proto         string
+	client        *http.Client
+	ctx           caddy.Context
+	loopCtx       context.Context
+	events        *caddyevents.App
+	refreshes     singleflight.Group
+	wg            sync.WaitGroup
+	poolKey       string
+	carryKey      string
+	schedule      *schedule
+	clk           clock
+	refreshSignal os.Signal
+	shared        *ParspackIPRange
+	pool          *fetcher
+	notifyClient  *http.Client
+	stopMu        sync.Mutex
+	stopped       bool
+
+	// transformers are those passed in from Go followed by the ones
+	// loaded from TransformersRaw
+	transformers []Transformer
+
+	// lifetime is the freshness lifetime of the last list response in
+	// nanoseconds with AutoInterval, 0 if it had no caching headers. It is
+	// atomic as period is called with mu held.
+	lifetime atomic.Int64
+
+	// ipv6Endpoint overrides ipv6URL and nameservers the ones from
+	// resolv.conf, only set by tests
+	ipv6Endpoint string
+	nameservers  []string
+}
+
+// BasicAuth holds HTTP basic authentication credentials
+type BasicAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// validators holds the cache validators returned by an endpoint along with
+// the ranges parsed from that response, reused on 304 Not Modified
+type validators struct {
+	etag         string
+	lastModified string
+	ranges       []netip.Prefix
 }
 
 // CaddyModule returns the Caddy module information
-func (ParspackIPRange) CaddyModule() caddy.ModuleInfo {
+func (*ParspackIPRange) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.ip_sources.parspack",
 		New: func() caddy.Module { return new(ParspackIPRange) },
@@ -48,158 +505,1998 @@ func (ParspackIPRange) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner
 func (p *ParspackIPRange) Provision(ctx caddy.Context) error {
-	p.logger = ctx.Logger(p)
+	p.ctx = ctx
+	p.started = p.now()
+	if p.logger == nil {
+		p.logger = ctx.Logger(p)
+	}
+	if err := p.prepare(); err != nil {
+		return err
+	}
+	// Caddy only calls Validate once Provision has returned, by which time
+	// the loop would already have fetched, credentials included, with the
+	// rejected config
+	if err := p.Validate(); err != nil {
+		return err
+	}
 
-	// Set default interval if not specified
-	if p.Interval == 0 {
-		p.Interval = caddy.Duration(1 * time.Hour)
+	if err := initMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
 	}
+	eventsApp, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	p.events = eventsApp.(*caddyevents.App)
 
-	// Start background refresh
-	p.stop = make(chan struct{})
-	go p.refreshLoop()
+	// Transformers passed in from Go can't be compared, so an instance
+	// using them gets a fetcher of its own
+	private := len(p.transformers) > 0
+	if err := p.loadTransformers(ctx); err != nil {
+		return err
+	}
+	if private {
+		err = p.start()
+	} else {
+		err = p.join()
+	}
+	if err != nil {
+		return err
+	}
+	registerInstance(p)
 
 	return nil
 }
 
-// GetIPRanges implements caddyhttp.IPRangeSource
-func (p *ParspackIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	return p.ipRanges
-}
+// prepare applies the defaults and expands the placeholders of the config.
+// It doesn't depend on the Caddy context, so that parspack-check can run it
+// on a config without loading it.
+func (p *ParspackIPRange) prepare() error {
+	var err error
 
-// fetchIPRanges fetches IP ranges from ParsPack endpoint
-func (p *ParspackIPRange) fetchIPRanges() error {
-	ranges, err := p.fetchFromURL(ipv4URL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch IPv4 ranges: %w", err)
+	// Set default interval if not specified, and keep it above a sane
+	// minimum so parspack.com isn't hammered
+	if p.Schedule != "" {
+		if p.schedule, err = parseSchedule(p.Schedule); err != nil {
+			return err
+		}
+	} else if p.Interval == 0 {
+		p.Interval = caddy.Duration(defaultInterval)
+	}
+	if p.AutoInterval {
+		if p.MinInterval == 0 {
+			p.MinInterval = caddy.Duration(defaultMinAutoInterval)
+		}
+		if p.MaxInterval == 0 {
+			p.MaxInterval = caddy.Duration(defaultMaxAutoInterval)
+		}
+		p.MinInterval = caddy.Duration(max(time.Duration(p.MinInterval), minInterval))
+	}
+	if p.RefreshSignal != "" {
+		if p.refreshSignal, err = parseSignal(p.RefreshSignal); err != nil {
+			return err
+		}
+	}
+	if p.Interval > 0 && time.Duration(p.Interval) < minInterval {
+		p.log().Warn("interval is below the minimum, clamping",
+			zap.Duration("interval", time.Duration(p.Interval)),
+			zap.Duration("minimum", minInterval))
+		p.Interval = caddy.Duration(minInterval)
 	}
 
-	p.mu.Lock()
-	p.ipRanges = ranges
-	p.mu.Unlock()
-
-	p.logger.Info("successfully fetched IP ranges", zap.Int("count", len(ranges)))
-	return nil
-}
-
-// fetchFromURL fetches IP ranges from a URL
-func (p *ParspackIPRange) fetchFromURL(url string) ([]netip.Prefix, error) {
-	ctx := context.Background()
-	if p.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(p.Timeout))
-		defer cancel()
+	// Set default timeout if not specified, so a stalled connection can
+	// never hang a refresh
+	if p.Timeout == 0 {
+		p.Timeout = caddy.Duration(defaultTimeout)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
+	// Set default retry behavior if not specified
+	if p.MaxRetries == 0 {
+		p.MaxRetries = defaultMaxRetries
+	}
+	if p.RetryBackoff == 0 {
+		p.RetryBackoff = caddy.Duration(defaultRetryBackoff)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if p.MaxBodySize == 0 {
+		p.MaxBodySize = defaultMaxBodySize
+	}
+	if p.MaxParseWarnings == 0 {
+		p.MaxParseWarnings = defaultMaxParseWarnings
+	}
+	if p.CacheTTL == 0 {
+		p.CacheTTL = caddy.Duration(defaultCacheTTL)
+	}
+	if p.OnError == "" {
+		p.OnError = onErrorKeep
+	}
+	if p.RetryJitter == "" {
+		p.RetryJitter = retryJitterFull
+	}
+	if p.Family == "" {
+		p.Family = familyBoth
+	}
+	if p.NotifyURL != "" && p.NotifyOn == "" {
+		p.NotifyOn = notifyAlways
+	}
+	if p.FailureLogLevel == "" {
+		p.FailureLogLevel = "error"
+	}
+	if p.MaxRanges == 0 {
+		p.MaxRanges = defaultMaxRanges
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	// Set default transport tuning if not specified
+	if p.IdleConnTimeout == 0 {
+		p.IdleConnTimeout = caddy.Duration(defaultIdleConnTimeout)
+	}
+	if p.MaxIdleConns == 0 {
+		p.MaxIdleConns = defaultMaxIdleConns
+	}
+	if p.TLSHandshakeTimeout == 0 {
+		p.TLSHandshakeTimeout = caddy.Duration(defaultTLSHandshakeTimeout)
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	// Expand global placeholders such as {env.PARSPACK_URL}, so the
+	// sources can be set from the environment
+	repl := caddy.NewReplacer()
+	if p.URL, err = expandURL(repl, p.URL); err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	for i := range p.Fallbacks {
+		if p.Fallbacks[i], err = expandURL(repl, p.Fallbacks[i]); err != nil {
+			return fmt.Errorf("fallback: %w", err)
+		}
+	}
+	if p.ChecksumURL, err = expandURL(repl, p.ChecksumURL); err != nil {
+		return fmt.Errorf("checksum_url: %w", err)
+	}
+	if p.NotifyURL, err = expandURL(repl, p.NotifyURL); err != nil {
+		return fmt.Errorf("notify_url: %w", err)
+	}
+	if p.NotifyURL, err = normalizeURL(p.NotifyURL); err != nil {
+		return fmt.Errorf("notify_url: %w", err)
+	}
+	if p.URL, err = normalizeURL(p.URL); err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	for i := range p.Fallbacks {
+		if p.Fallbacks[i], err = normalizeURL(p.Fallbacks[i]); err != nil {
+			return fmt.Errorf("fallback: %w", err)
+		}
+	}
+	if p.ChecksumURL, err = normalizeURL(p.ChecksumURL); err != nil {
+		return fmt.Errorf("checksum_url: %w", err)
+	}
+	for i := range p.Merge {
+		if p.Merge[i].URL, err = expandURL(repl, p.Merge[i].URL); err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+		if p.Merge[i].URL, err = normalizeURL(p.Merge[i].URL); err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+	}
+	if p.BasicAuth != nil {
+		p.BasicAuth.Username = repl.ReplaceKnown(p.BasicAuth.Username, "")
+		p.BasicAuth.Password = repl.ReplaceKnown(p.BasicAuth.Password, "")
+	}
+	p.BearerToken = repl.ReplaceKnown(p.BearerToken, "")
+	for _, values := range p.Headers {
+		for i := range values {
+			values[i] = repl.ReplaceKnown(values[i], "")
+		}
+	}
+	if (p.BasicAuth != nil || p.BearerToken != "") && strings.HasPrefix(p.URL, "http://") {
+		p.log().Warn("source credentials are sent over plain HTTP", zap.String("url", p.URL))
 	}
 
-	return p.parseIPRanges(string(body))
+	// Fall back to the official endpoint if no URL is configured
+	if p.URL == "" {
+		p.URL = ipv4URL
+	}
+	return nil
 }
 
-// parseIPRanges parses IP ranges from text (one per line, CIDR format)
-func (p *ParspackIPRange) parseIPRanges(text string) ([]netip.Prefix, error) {
-	var ranges []netip.Prefix
-	lines := strings.Split(text, "\n")
+// start loads the static and cached ranges and starts the refresh loop. It
+// only runs for the first instance of a given configuration.
+func (p *ParspackIPRange) start() error {
+	var err error
+	p.client, err = p.newHTTPClient()
+	if err != nil {
+		return err
+	}
+	// The webhook is another host, which must not get the client
+	// certificate, proxy or TLS settings of the list endpoint
+	p.notifyClient = &http.Client{}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	// Parse static ranges
+	for _, cidr := range p.Additional {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid additional range %q: %v", cidr, err)
 		}
-
-		prefix, err := caddyhttp.CIDRExpressionToPrefix(line)
+		p.additional = append(p.additional, unmapPrefix(prefix))
+	}
+	for _, cidr := range p.Exclude {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
 		if err != nil {
-			p.logger.Warn("failed to parse IP range", zap.String("range", line), zap.Error(err))
-			continue
+			return fmt.Errorf("invalid exclude range %q: %v", cidr, err)
 		}
+		p.exclude = append(p.exclude, unmapPrefix(prefix))
+	}
+	p.mu.Lock()
+	p.rebuildLocked()
+	p.mu.Unlock()
+	if err := p.loadOverrideFiles(true); err != nil {
+		return err
+	}
+	if p.StaticOnly {
+		return nil
+	}
 
-		ranges = append(ranges, prefix)
+	// Pick up the ranges of a previous config fetching the same lists, or
+	// seed them from the cache file before the first fetch
+	p.carryKey = p.fetchKey()
+	carriedOver := p.loadCarried()
+	if !carriedOver {
+		if err := p.loadCache(); err != nil {
+			p.log().Warn("failed to load cache file", zap.String("file", p.CacheFile), zap.Error(err))
+		}
+		if err := p.loadBootstrap(); err != nil {
+			return err
+		}
 	}
 
-	return ranges, nil
-}
+	// Start background refresh. The loop may outlive the config that
+	// started it when its fetcher is shared with a newer config, so it is
+	// only cancelled when the last instance using it is cleaned up.
+	p.loopCtx, p.cancel = context.WithCancel(context.Background())
 
-// refreshLoop periodically refreshes the IP ranges
-func (p *ParspackIPRange) refreshLoop() {
-	// First time fetch
-	if err := p.fetchIPRanges(); err != nil {
-		p.logger.Warn("failed to fetch initial IP ranges", zap.Error(err))
+	if p.WaitForFirstFetch && !carriedOver {
+		if err := p.refresh(p.loopCtx); err != nil {
+			p.cancel()
+			return fmt.Errorf("initial fetch failed: %w", err)
+		}
 	}
 
-	ticker := time.NewTicker(time.Duration(p.Interval))
-	defer ticker.Stop()
+	p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+	if len(p.Resolve) > 0 {
+		p.wg.Go(func() { p.resolveLoop(p.loopCtx) })
+	}
+	p.watchSignal()
+	return nil
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			if err := p.fetchIPRanges(); err != nil {
-				p.logger.Error("failed to refresh IP ranges", zap.Error(err))
+// Validate implements caddy.Validator. Provision already calls it before
+// anything is fetched, so the second call by Caddy is only a cheap check.
+func (p *ParspackIPRange) Validate() error {
+	if p.Schedule != "" {
+		if p.Interval != 0 {
+			return fmt.Errorf("interval and schedule are mutually exclusive")
+		}
+		s, err := parseSchedule(p.Schedule)
+		if err != nil {
+			return err
+		}
+		if s.next(p.now()).IsZero() {
+			return fmt.Errorf("schedule %q never matches", p.Schedule)
+		}
+	} else if p.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", time.Duration(p.Interval))
+	}
+	if p.AutoInterval {
+		if p.Schedule != "" {
+			return fmt.Errorf("interval auto and schedule are mutually exclusive")
+		}
+		if p.MinInterval < 0 || p.MaxInterval < 0 {
+			return fmt.Errorf("min_interval and max_interval must not be negative")
+		}
+		if p.MaxInterval > 0 && p.MinInterval > p.MaxInterval {
+			return fmt.Errorf("min_interval %v is above max_interval %v",
+				time.Duration(p.MinInterval), time.Duration(p.MaxInterval))
+		}
+	} else if p.MinInterval != 0 || p.MaxInterval != 0 {
+		return fmt.Errorf("min_interval and max_interval require interval auto")
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %v", time.Duration(p.Timeout))
+	}
+	// A slow fetch would still be running when the next one is due
+	if p.Interval > 0 && p.Timeout > 0 && p.Interval <= p.Timeout {
+		return fmt.Errorf("interval %v must be longer than timeout %v",
+			time.Duration(p.Interval), time.Duration(p.Timeout))
+	}
+	if p.AutoInterval && p.Timeout > 0 && p.MinInterval > 0 && p.MinInterval <= p.Timeout {
+		return fmt.Errorf("min_interval %v must be longer than timeout %v",
+			time.Duration(p.MinInterval), time.Duration(p.Timeout))
+	}
+	if p.InitialDelay < 0 {
+		return fmt.Errorf("initial_delay must not be negative, got %v", time.Duration(p.InitialDelay))
+	}
+	if p.InitialDelay > 0 && p.WaitForFirstFetch {
+		return fmt.Errorf("initial_delay cannot be combined with wait_for_first_fetch")
+	}
+	if p.InitialRetry < 0 {
+		return fmt.Errorf("initial_retry must not be negative, got %v", time.Duration(p.InitialRetry))
+	}
+	if p.Jitter < 0 {
+		return fmt.Errorf("jitter must not be negative, got %v", time.Duration(p.Jitter))
+	}
+	if p.MaxRetries < -1 {
+		return fmt.Errorf("max_retries must be -1 or greater, got %d", p.MaxRetries)
+	}
+	if p.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative, got %d", p.MaxBodySize)
+	}
+	if p.MaxParseWarnings < -1 {
+		return fmt.Errorf("max_parse_warnings must be -1 or greater, got %d", p.MaxParseWarnings)
+	}
+	switch p.Format {
+	case "", formatAuto, formatText, formatJSON:
+	default:
+		return fmt.Errorf("format must be auto, text or json, got %q", p.Format)
+	}
+	switch p.Family {
+	case "", familyV4, familyV6, familyBoth:
+	default:
+		return fmt.Errorf("family must be v4, v6 or both, got %q", p.Family)
+	}
+	if p.Family == familyV6 && p.IPv6 != nil && !*p.IPv6 {
+		return fmt.Errorf("family v6 requires the IPv6 list, but ipv6 is disabled")
+	}
+	switch p.FailureLogLevel {
+	case "", "error", "warn", "debug":
+	default:
+		return fmt.Errorf("failure_log_level must be error, warn or debug, got %q", p.FailureLogLevel)
+	}
+	switch p.RetryJitter {
+	case "", retryJitterNone, retryJitterEqual, retryJitterFull:
+	default:
+		return fmt.Errorf("retry_jitter must be none, equal or full, got %q", p.RetryJitter)
+	}
+	switch p.OnError {
+	case "", onErrorKeep, onErrorClear:
+	default:
+		return fmt.Errorf("on_error must be keep or clear, got %q", p.OnError)
+	}
+	if p.MaxRanges < -1 {
+		return fmt.Errorf("max_ranges must be -1 or greater, got %d", p.MaxRanges)
+	}
+	for _, bounds := range []struct {
+		family   string
+		min, max int
+		bits     int
+	}{
+		{"IPv4", p.MinPrefixLen, p.MaxPrefixLen, 32},
+		{"IPv6", p.MinPrefixLenIPv6, p.MaxPrefixLenIPv6, 128},
+	} {
+		if bounds.min < 0 || bounds.min > bounds.bits || bounds.max < 0 || bounds.max > bounds.bits {
+			return fmt.Errorf("%s prefix length bounds must be between 0 and %d, got %d and %d", bounds.family, bounds.bits, bounds.min, bounds.max)
+		}
+		if bounds.max > 0 && bounds.min > bounds.max {
+			return fmt.Errorf("minimum %s prefix length must not exceed the maximum, got %d and %d", bounds.family, bounds.min, bounds.max)
+		}
+	}
+	if p.ReadyAfter < 0 {
+		return fmt.Errorf("ready_after must not be negative, got %d", p.ReadyAfter)
+	}
+	if p.ReadyAfter > 1 && (p.DisableRefresh || p.StaticOnly) {
+		return fmt.Errorf("ready_after requires refreshing, the instance would never become ready")
+	}
+	if p.ConfirmChanges < 0 {
+		return fmt.Errorf("confirm_changes must not be negative, got %d", p.ConfirmChanges)
+	}
+	if p.MinRatio < 0 || p.MinRatio > 1 {
+		return fmt.Errorf("min_ratio must be between 0 and 1, got %v", p.MinRatio)
+	}
+	if p.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle_conn_timeout must not be negative, got %v", time.Duration(p.IdleConnTimeout))
+	}
+	if p.MaxIdleConns < 0 {
+		return fmt.Errorf("max_idle_conns must not be negative, got %d", p.MaxIdleConns)
+	}
+	if p.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("tls_handshake_timeout must not be negative, got %v", time.Duration(p.TLSHandshakeTimeout))
+	}
+	switch p.HTTPVersion {
+	case "", "1.1", "2":
+	default:
+		return fmt.Errorf("http_version must be 1.1 or 2, got %q", p.HTTPVersion)
+	}
+	if p.HTTPVersion == "2" {
+		// HTTP/2 is only negotiated over TLS, so a plain http URL could
+		// never be fetched
+		urls := append([]string{p.URL, p.ChecksumURL}, p.Fallbacks...)
+		for _, m := range p.Merge {
+			urls = append(urls, m.URL)
+		}
+		for _, u := range urls {
+			if strings.HasPrefix(strings.ToLower(u), "http://") {
+				return fmt.Errorf("http_version 2 requires https URLs, got %q", u)
 			}
-		case <-p.stop:
-			return
 		}
 	}
-}
+	if p.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl must not be negative, got %v", time.Duration(p.CacheTTL))
+	}
+	if p.MaxStale < 0 {
+		return fmt.Errorf("max_stale must not be negative, got %v", time.Duration(p.MaxStale))
+	}
+	if p.FailClosed && p.MaxStale == 0 {
+		return fmt.Errorf("fail_closed requires max_stale")
+	}
+	if p.RetryBackoff < 0 {
+		return fmt.Errorf("retry_backoff must not be negative, got %v", time.Duration(p.RetryBackoff))
+	}
 
-// Cleanup implements caddy.CleanerUpper
-func (p *ParspackIPRange) Cleanup() error {
-	if p.stop != nil {
-		close(p.stop)
+	if err := validateURL(p.URL); err != nil {
+		return err
+	}
+	for _, fallback := range p.Fallbacks {
+		if err := validateURL(fallback); err != nil {
+			return fmt.Errorf("fallback: %w", err)
+		}
+	}
+	if p.ChecksumURL != "" {
+		if err := validateURL(p.ChecksumURL); err != nil {
+			return fmt.Errorf("checksum_url: %w", err)
+		}
+	}
+	if p.NotifyURL != "" {
+		if err := validateURL(p.NotifyURL); err != nil {
+			return fmt.Errorf("notify_url: %w", err)
+		}
+	}
+	switch p.NotifyOn {
+	case "", notifyAlways, notifyChange, notifyError:
+	default:
+		return fmt.Errorf("notify_on must be always, change or error, got %q", p.NotifyOn)
+	}
+	if p.NotifyOn != "" && p.NotifyURL == "" {
+		return fmt.Errorf("notify_on requires notify_url")
+	}
+	for _, m := range p.Merge {
+		if err := validateURL(m.URL); err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+		switch m.Format {
+		case "", formatAuto, formatText, formatJSON:
+		default:
+			return fmt.Errorf("merge: format must be auto, text or json, got %q", m.Format)
+		}
+	}
+	for _, host := range p.Resolve {
+		if err := validateHostname(host); err != nil {
+			return fmt.Errorf("resolve: %w", err)
+		}
+	}
+	if (p.ClientCertFile == "") != (p.ClientKeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	if p.BasicAuth != nil && p.BearerToken != "" {
+		return fmt.Errorf("basic_auth and bearer_token are mutually exclusive")
+	}
+	if p.StaticOnly {
+		if len(p.Additional) == 0 && len(p.AdditionalFiles) == 0 {
+			return fmt.Errorf("static_only requires additional ranges")
+		}
+		if len(p.Resolve) > 0 || p.WaitForFirstFetch {
+			return fmt.Errorf("static_only cannot be combined with resolve or wait_for_first_fetch")
+		}
+	}
+	switch p.Method {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return fmt.Errorf("method must be GET, POST, PUT or PATCH, got %q", p.Method)
+	}
+	for name, values := range p.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid value for header %s: must not contain line breaks", name)
+			}
+		}
 	}
 	return nil
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler
-func (p *ParspackIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // Skip module name
+// expandURL replaces the global placeholders in rawURL. A URL that only
+// becomes empty through expansion, e.g. from an unset environment
+// variable, is an error rather than silently falling back to a default.
+func expandURL(repl *caddy.Replacer, rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", nil
+	}
+	expanded := strings.TrimSpace(repl.ReplaceKnown(rawURL, ""))
+	if expanded == "" {
+		return "", fmt.Errorf("%q expanded to an empty string", rawURL)
+	}
+	return expanded, nil
+}
 
-	// No same-line options are supported
-	if d.NextArg() {
-		return d.ArgErr()
+// normalizeURL parses rawURL and returns it in the form sent on the wire:
+// an internationalized host is converted to punycode and the path is
+// percent-encoded where needed. Empty URLs are returned as is.
+func normalizeURL(rawURL string) (string, error) {
+	if rawURL == "" {
+		return "", nil
 	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %v", rawURL, err)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
 
-	for nesting := d.Nesting(); d.NextBlock(nesting); {
-		switch d.Val() {
+	if host := u.Hostname(); !isASCII(host) {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid url %q: host %q: %v", rawURL, host, err)
+		}
+		if port := u.Port(); port != "" {
+			ascii = net.JoinHostPort(ascii, port)
+		}
+		u.Host = ascii
+	}
+	return u.String(), nil
+}
+
+// isASCII reports whether s only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// validateURL checks that rawURL is an absolute http or https URL
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid url %q: missing host", rawURL)
+	}
+	return nil
+}
+
+// GetIPRanges implements caddyhttp.IPRangeSource. It returns a copy of the
+// current ranges, which the caller may keep and modify freely; Contains
+// avoids the copy for a single lookup.
+func (p *ParspackIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
+	p = p.source()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.ipRanges)
+}
+
+// Contains reports whether addr falls within one of the current ranges,
+// with IPv4-mapped IPv6 addresses matched as the IPv4 address they map. It
+// uses a binary search over a sorted, collapsed copy of the ranges, or a
+// trie built from it for very large lists.
+func (p *ParspackIPRange) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	p = p.source()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.trie != nil {
+		return p.trie.contains(addr)
+	}
+	return containsSorted(p.lookup, addr)
+}
+
+// Ready reports whether the instance is serving a usable range set: a fetch
+// has succeeded and, unless refreshing is disabled, the last success is no
+// older than three intervals. Static-only instances are ready as soon as
+// their ranges are parsed.
+func (p *ParspackIPRange) Ready() bool {
+	p = p.source()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.readyLocked()
+}
+
+// readyLocked implements Ready. p.mu must be held.
+func (p *ParspackIPRange) readyLocked() bool {
+	if p.StaticOnly {
+		return len(p.ipRanges) > 0
+	}
+	if p.lastFetch.IsZero() || len(p.fetched) == 0 || p.successes < p.ReadyAfter {
+		return false
+	}
+	if p.DisableRefresh {
+		return true
+	}
+	return p.now().Sub(p.lastFetch) <= readyStaleFactor*p.period()
+}
+
+// rebuildLocked recomputes the served ranges from the fetched and static
+// ones, and records when they last changed. The served slices are always
+// replaced, never modified in place.
+// p.mu must be held for writing.
+func (p *ParspackIPRange) rebuildLocked() {
+	ranges := make([]netip.Prefix, 0, len(p.fetched)+len(p.additional)+len(p.resolved))
+	ranges = append(ranges, p.fetched...)
+	for _, m := range p.Merge {
+		ranges = append(ranges, p.merged[m.URL]...)
+	}
+	ranges = append(ranges, p.additional...)
+	for _, path := range p.AdditionalFiles {
+		ranges = append(ranges, p.fileIncludes[path]...)
+	}
+	for prefix := range p.resolved {
+		ranges = append(ranges, prefix)
+	}
+	if p.Family == familyV4 || p.Family == familyV6 {
+		ranges = slices.DeleteFunc(ranges, func(prefix netip.Prefix) bool {
+			return prefix.Addr().Is6() != (p.Family == familyV6)
+		})
+	}
+	ranges = excludeRanges(ranges, p.exclude)
+	for _, path := range p.ExcludeFiles {
+		ranges = excludeRanges(ranges, p.fileExcludes[path])
+	}
+	served := normalizeRanges(ranges, p.Collapse)
+	if !slices.Equal(served, p.ipRanges) {
+		p.modified = p.now()
+	}
+	p.ipRanges = served
+	p.lookup = normalizeRanges(p.ipRanges, true)
+	p.trie = nil
+	if len(p.lookup) >= trieThreshold {
+		p.trie = newTrie(p.lookup)
+	}
+
+	if removed := len(ranges) - len(p.ipRanges); removed > 0 && p.current().logger != nil {
+		p.log().Debug("removed redundant IP ranges", zap.Int("removed", removed))
+	}
+}
+
+// ipv6ListURL returns the IPv6 list endpoint, which tests point at a local
+// server
+func (p *ParspackIPRange) ipv6ListURL() string {
+	if p.ipv6Endpoint != "" {
+		return p.ipv6Endpoint
+	}
+	return ipv6URL
+}
+
+// ipv6Enabled reports whether the IPv6 list should be fetched
+func (p *ParspackIPRange) ipv6Enabled() bool {
+	return p.Family != familyV4 && (p.IPv6 == nil || *p.IPv6)
+}
+
+// refresh fetches the IP ranges. Overlapping callers, such as the refresh
+// loop and manual admin API triggers, share a single in-flight fetch and
+// its result.
+func (p *ParspackIPRange) refresh(ctx context.Context) error {
+	if p.StaticOnly {
+		return nil
+	}
+	_, err, _ := p.refreshes.Do("refresh", func() (any, error) {
+		// Failures are logged and keep the previous ranges of the file
+		_ = p.loadOverrideFiles(false)
+		return nil, p.fetchIPRanges(ctx)
+	})
+	return err
+}
+
+// fetchIPRanges fetches IP ranges from ParsPack endpoints
+func (p *ParspackIPRange) fetchIPRanges(ctx context.Context) error {
+	p.mu.RLock()
+	prev := p.fetched
+	prevV6 := p.ipv6Ranges
+	p.mu.RUnlock()
+	prevCount := len(prev)
+
+	p.refreshMerged(ctx)
+
+	var ranges, v6 []netip.Prefix
+	var source string
+	var err error
+	if p.File != "" {
+		source = p.File
+		ranges, v6, err = p.readFile()
+	} else {
+		ranges, v6, source, err = p.fetchRemote(ctx, prevV6)
+	}
+	if err != nil {
+		return p.recordFailure(err)
+	}
+
+	sources := p.tagSources(ranges, v6, source)
+	if len(p.current().transformers) > 0 {
+		if ranges, sources, err = p.transform(ranges, sources); err != nil {
+			return p.recordFailure(err)
+		}
+		v6 = ipv6Only(ranges)
+	}
+
+	// A runaway list would bloat memory and every lookup
+	if p.MaxRanges > 0 && len(ranges) > p.MaxRanges {
+		p.log().Error("fetched list exceeds max_ranges, keeping previous ranges",
+			zap.Int("fetched", len(ranges)),
+			zap.Int("max_ranges", p.MaxRanges))
+		return p.recordFailure(fmt.Errorf("%w: fetched %d, max_ranges is %d", ErrTooManyRanges, len(ranges), p.MaxRanges))
+	}
+
+	// A list that shrank suspiciously is more likely a truncated download
+	// than a real change
+	if p.MinRatio > 0 && prevCount > 0 && float64(len(ranges)) < p.MinRatio*float64(prevCount) {
+		p.log().Warn("fetched list shrank below min_ratio, keeping previous ranges",
+			zap.Int("previous", prevCount),
+			zap.Int("fetched", len(ranges)),
+			zap.Float64("min_ratio", p.MinRatio))
+		return p.recordFailure(fmt.Errorf("fetched %d ranges, fewer than %v of the previous %d", len(ranges), p.MinRatio, prevCount))
+	}
+
+	p.mu.Lock()
+	ranges, v6 = p.stageRemovalsLocked(prev, ranges, v6, sources)
+	p.fetched = ranges
+	p.ipv6Ranges = v6
+	p.sources = sources
+	p.rebuildLocked()
+	served := len(p.ipRanges)
+	p.lastFetch = p.now()
+	p.lastErr = nil
+	p.failures = 0
+	p.successes++
+	p.saveCarriedLocked()
+	p.mu.Unlock()
+
+	observeFetch(nil)
+	ipv6Count := len(ipv6Only(ranges))
+	p.log().Info("successfully fetched IP ranges",
+		zap.Int("count", len(ranges)),
+		zap.Int("ipv4", len(ranges)-ipv6Count),
+		zap.Int("ipv6", ipv6Count))
+
+	if err := p.saveCache(ranges); err != nil {
+		p.log().Warn("failed to write cache file", zap.String("file", p.CacheFile), zap.Error(err))
+	}
+
+	added, removed := diffRanges(prev, ranges)
+	changed := len(added) > 0 || len(removed) > 0
+	if changed {
+		p.logRangeChanges(added, removed)
+		p.emit(rangesChangedEvent, map[string]any{
+			"added":   len(added),
+			"removed": len(removed),
+			"count":   len(ranges),
+		})
+	}
+	p.notify(nil, changed, served)
+	return nil
+}
+
+// stageRemovalsLocked keeps the ranges of prev missing from ranges until
+// they have been missing from ConfirmChanges consecutive fetches, and
+// returns ranges and v6 with the kept ones added back. Only ranges of a
+// previous successful fetch are staged, not cached or bootstrap ones.
+// p.mu must be held.
+func (p *ParspackIPRange) stageRemovalsLocked(prev, ranges, v6 []netip.Prefix, sources map[netip.Prefix]string) ([]netip.Prefix, []netip.Prefix) {
+	if p.ConfirmChanges <= 1 || p.lastFetch.IsZero() {
+		p.pending = nil
+		return ranges, v6
+	}
+
+	_, removed := diffRanges(prev, ranges)
+	pending := make(map[netip.Prefix]int, len(removed))
+	var confirmed []netip.Prefix
+	for _, prefix := range removed {
+		// Ranges back in the list drop out of pending, starting over if
+		// they go missing again
+		seen := p.pending[prefix] + 1
+		if seen >= p.ConfirmChanges {
+			confirmed = append(confirmed, prefix)
+			continue
+		}
+		pending[prefix] = seen
+		ranges = append(ranges, prefix)
+		if prefix.Addr().Is6() {
+			v6 = append(v6, prefix)
+		}
+		if _, ok := sources[prefix]; !ok {
+			sources[prefix] = p.sources[prefix]
+		}
+	}
+	p.pending = pending
+
+	if len(pending) > 0 {
+		p.log().Info("staging removal of IP ranges until it is confirmed",
+			zap.Int("pending", len(pending)),
+			zap.Int("confirm_changes", p.ConfirmChanges))
+	}
+	if len(confirmed) > 0 {
+		p.log().Info("removal of IP ranges confirmed", zap.Stringers("removed", confirmed))
+	}
+	return ranges, v6
+}
+
+// fetchRemote fetches the IPv4 list and, if enabled, the IPv6 list. It
+// returns all fetched ranges along with the IPv6 subset and the URL the
+// IPv4 list was served from.
+func (p *ParspackIPRange) fetchRemote(ctx context.Context, prevV6 []netip.Prefix) (ranges, v6 []netip.Prefix, source string, err error) {
+	v4, source, err := p.fetchWithFallback(ctx)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to fetch IPv4 ranges: %w", err)
+	}
+	if len(v4) == 0 {
+		return nil, nil, "", fmt.Errorf("fetched IPv4 list is empty, keeping previous ranges: %w", ErrEmptyList)
+	}
+
+	v6 = prevV6
+	if p.ipv6Enabled() {
+		// A failed IPv6 fetch keeps the previously loaded IPv6 ranges
+		// instead of discarding the freshly fetched IPv4 ones
+		fetched, err := p.fetchWithRetry(ctx, p.ipv6ListURL(), "")
+		switch {
+		case err != nil:
+			p.log().Warn("failed to fetch IPv6 ranges, keeping previous ones", zap.Error(err))
+		case len(fetched) == 0 && len(v6) > 0:
+			p.log().Warn("fetched IPv6 list is empty, keeping previous ones")
+		default:
+			v6 = fetched
+		}
+	}
+
+	ranges = make([]netip.Prefix, 0, len(v4)+len(v6))
+	ranges = append(ranges, v4...)
+	ranges = append(ranges, v6...)
+	return ranges, v6, source, nil
+}
+
+// tagSources maps each fetched prefix to where it came from: the file or
+// URL the list was read from, or the IPv6 list URL for the IPv6 ranges of
+// a remote fetch
+func (p *ParspackIPRange) tagSources(ranges, v6 []netip.Prefix, source string) map[netip.Prefix]string {
+	sources := make(map[netip.Prefix]string, len(ranges))
+	for i, prefix := range ranges {
+		tag := source
+		if p.File == "" && i >= len(ranges)-len(v6) {
+			tag = p.ipv6ListURL()
+		}
+		if _, ok := sources[prefix]; !ok {
+			sources[prefix] = tag
+		}
+	}
+	return sources
+}
+
+// readFile reads the ranges from the local file configured with File. It
+// returns all ranges along with the IPv6 subset.
+func (p *ParspackIPRange) readFile() (ranges, v6 []netip.Prefix, err error) {
+	data, err := os.ReadFile(p.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read IP ranges file: %w", err)
+	}
+	contentType := ""
+	if strings.EqualFold(filepath.Ext(p.File), ".json") {
+		contentType = "application/json"
+	}
+	ranges, err = p.parseList(data, p.Format, contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	if listFormat(p.Format, contentType) == formatText {
+		p.recordListVersion(p.File, data)
+	}
+	if len(ranges) == 0 {
+		return nil, nil, fmt.Errorf("IP ranges file %s is empty, keeping previous ranges: %w", p.File, ErrEmptyList)
+	}
+	return ranges, ipv6Only(ranges), nil
+}
+
+// rangesChangedEvent is emitted whenever a refresh changes the fetched ranges
+const rangesChangedEvent = "parspack.ranges_changed"
+
+// logRangeChanges logs the prefixes added and removed by a refresh. Large
+// diffs, such as the first fetch after startup, are logged at Debug level
+// to keep the log readable; the counts are always logged at Info level.
+func (p *ParspackIPRange) logRangeChanges(added, removed []netip.Prefix) {
+	msg := fmt.Sprintf("IP ranges changed: %d added, %d removed", len(added), len(removed))
+	fields := []zap.Field{
+		zap.Stringers("added", added),
+		zap.Stringers("removed", removed),
+	}
+	if len(added)+len(removed) <= maxLoggedChanges {
+		p.log().Info(msg, fields...)
+		return
+	}
+	p.log().Info(msg)
+	p.log().Debug(msg, fields...)
+}
+
+// emit dispatches an event through Caddy's event system, on the events
+// app of the most recent config using the fetcher
+func (p *ParspackIPRange) emit(name string, data map[string]any) {
+	cur := p.current()
+	if cur.events == nil {
+		return
+	}
+	cur.events.Emit(cur.ctx, name, data)
+}
+
+// recordFailure stores err as the last error of the instance and returns it
+func (p *ParspackIPRange) recordFailure(err error) error {
+	p.mu.Lock()
+	p.lastErr = err
+	p.failures++
+	if p.successes < p.ReadyAfter {
+		// The successes required by ReadyAfter must be consecutive
+		p.successes = 0
+	}
+	stale := p.staleLocked()
+	if stale {
+		p.log().Error("IP ranges are stale, every refresh has been failing",
+			zap.Duration("age", p.ageLocked()),
+			zap.Duration("max_stale", time.Duration(p.MaxStale)),
+			zap.Int("consecutive_failures", p.failures),
+			zap.Bool("fail_closed", p.FailClosed))
+	}
+	if (p.OnError == onErrorClear || (stale && p.FailClosed)) && len(p.fetched) > 0 {
+		if p.OnError == onErrorClear {
+			p.log().Warn("fetch failed, no longer trusting the fetched ranges",
+				zap.Bool("first_fetch", p.lastFetch.IsZero()),
+				zap.Int("cleared", len(p.fetched)))
+		}
+		p.fetched = nil
+		p.sources = nil
+		p.ipv6Ranges = nil
+		p.rebuildLocked()
+	}
+	count := len(p.ipRanges)
+	p.mu.Unlock()
+	observeFetch(err)
+	p.notify(err, false, count)
+	return err
+}
+
+// ageLocked returns the time since the last successful fetch, or since
+// Provision if no fetch has succeeded yet. p.mu must be held.
+func (p *ParspackIPRange) ageLocked() time.Duration {
+	if p.lastFetch.IsZero() {
+		return p.now().Sub(p.started)
+	}
+	return p.now().Sub(p.lastFetch)
+}
+
+// staleLocked reports whether the ranges are older than MaxStale. p.mu
+// must be held.
+func (p *ParspackIPRange) staleLocked() bool {
+	return !p.StaticOnly && p.MaxStale > 0 && p.ageLocked() > time.Duration(p.MaxStale)
+}
+
+// parseList parses a fetched list in the format given by listFormat
+func (p *ParspackIPRange) parseList(data []byte, format, contentType string) ([]netip.Prefix, error) {
+	if listFormat(format, contentType) == formatJSON {
+		return p.parseJSONRanges(data)
+	}
+	return p.parseIPRanges(string(data))
+}
+
+// listFormat returns the format a list configured with format and served
+// with contentType is parsed in. With the auto format, lists served with a
+// JSON media type are decoded as JSON and anything else as text.
+func listFormat(format, contentType string) string {
+	if format != "" && format != formatAuto {
+		return format
+	}
+	if isJSONMediaType(contentType) {
+		return formatJSON
+	}
+	return formatText
+}
+
+// isHTMLMediaType reports whether a Content-Type header denotes HTML
+func isHTMLMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// isJSONMediaType reports whether a Content-Type header denotes JSON
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// jsonList is the JSON form of a list, e.g.
+// {"ipv4": ["1.2.3.0/24"], "ipv6": ["2001:db8::/32"]}
+type jsonList struct {
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+}
+
+// parseJSONRanges decodes a JSON list. Its entries accept the same formats
+// as lines of a text list and are skipped the same way when unparseable.
+func (p *ParspackIPRange) parseJSONRanges(data []byte) ([]netip.Prefix, error) {
+	var list jsonList
+	if err := json.Unmarshal(bytes.TrimPrefix(data, []byte("\ufeff")), &list); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", ErrMalformedList, err)
+	}
+	entries := append(list.IPv4, list.IPv6...)
+	for i, entry := range entries {
+		// An entry must not turn into several lines
+		entries[i] = strings.NewReplacer("\r", " ", "\n", " ").Replace(entry)
+	}
+	return p.parseIPRanges(strings.Join(entries, "\n"))
+}
+
+// parseIPRanges parses IP ranges from text, one per line in CIDR or
+// start-end format. Bare addresses are accepted as /32 or /128 host routes.
+// Unparseable lines are skipped, but a list with no valid line at all, or
+// with any invalid line in Strict mode, fails with ErrMalformedList.
+func (p *ParspackIPRange) parseIPRanges(text string) ([]netip.Prefix, error) {
+	var ranges []netip.Prefix
+	skipped := 0
+	for line := range scanRanges(text) {
+		if line.err != nil {
+			skipped++
+			if skipped <= p.MaxParseWarnings {
+				p.log().Warn("failed to parse IP range", zap.String("range", line.text), zap.Error(line.err))
+			}
+			continue
+		}
+		ranges = append(ranges, p.filterRanges(line.prefixes)...)
+	}
+
+	if skipped > max(p.MaxParseWarnings, 0) {
+		p.log().Warn(fmt.Sprintf("skipped %d unparseable lines", skipped),
+			zap.Int("logged", max(p.MaxParseWarnings, 0)))
+	}
+	if len(ranges) == 0 && skipped > 0 {
+		return nil, fmt.Errorf("%w: none of %d lines could be parsed", ErrMalformedList, skipped)
+	}
+	if p.Strict && skipped > 0 {
+		return nil, fmt.Errorf("%w: %d lines could not be parsed in strict mode", ErrMalformedList, skipped)
+	}
+	return ranges, nil
+}
+
+// filterRanges drops and logs the prefixes outside the prefix length
+// bounds of their family, and with DropPrivate the reserved ones
+func (p *ParspackIPRange) filterRanges(ranges []netip.Prefix) []netip.Prefix {
+	return slices.DeleteFunc(ranges, func(prefix netip.Prefix) bool {
+		if p.DropPrivate && isReserved(prefix) {
+			p.log().Warn("dropping private or reserved IP range", zap.Stringer("range", prefix))
+			return true
+		}
+		lo, hi := p.MinPrefixLen, p.MaxPrefixLen
+		if prefix.Addr().Is6() {
+			lo, hi = p.MinPrefixLenIPv6, p.MaxPrefixLenIPv6
+		}
+		if prefix.Bits() >= lo && (hi == 0 || prefix.Bits() <= hi) {
+			return false
+		}
+		p.log().Warn("dropping IP range outside the allowed prefix lengths",
+			zap.Stringer("range", prefix),
+			zap.Int("min", lo),
+			zap.Int("max", hi))
+		return true
+	})
+}
+
+// listVersion returns the version a text list publishes in its leading
+// comment lines, such as "# updated 2024-01-01", if any
+func listVersion(text string) (string, bool) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "#")
+		if !ok {
+			// Only the header is looked at, not annotations further down
+			return "", false
+		}
+		fields := strings.Fields(comment)
+		if len(fields) >= 2 && strings.EqualFold(strings.TrimSuffix(fields[0], ":"), "updated") {
+			return strings.Join(fields[1:], " "), true
+		}
+	}
+	return "", false
+}
+
+// parseSpan parses the endpoints of a start-end IP range and converts it to
+// prefixes
+func parseSpan(startStr, endStr string) ([]netip.Prefix, error) {
+	start, err := netip.ParseAddr(startStr)
+	if err != nil {
+		return nil, err
+	}
+	end, err := netip.ParseAddr(endStr)
+	if err != nil {
+		return nil, err
+	}
+	return rangeToPrefixes(start.Unmap(), end.Unmap())
+}
+
+// nextRefresh returns the delay until the next refresh, randomized by up to
+// Jitter
+func (p *ParspackIPRange) nextRefresh() time.Duration {
+	delay := p.baseInterval()
+	if p.Jitter > 0 {
+		delay += rand.N(time.Duration(p.Jitter))
+	}
+	return delay
+}
+
+// baseInterval returns the time between two refreshes without a schedule:
+// Interval, or with AutoInterval the freshness lifetime of the last response
+// clamped between MinInterval and MaxInterval
+func (p *ParspackIPRange) baseInterval() time.Duration {
+	if !p.AutoInterval {
+		return time.Duration(p.Interval)
+	}
+	lifetime := time.Duration(p.lifetime.Load())
+	if lifetime == 0 {
+		lifetime = time.Duration(p.Interval)
+	}
+	lifetime = max(lifetime, time.Duration(p.MinInterval))
+	if p.MaxInterval > 0 {
+		lifetime = min(lifetime, time.Duration(p.MaxInterval))
+	}
+	return lifetime
+}
+
+// nextAfter returns when the refresh following one at t should happen:
+// Interval after t, or at the first scheduled time after t delayed by up
+// to Jitter
+func (p *ParspackIPRange) nextAfter(t time.Time) time.Time {
+	if p.schedule == nil {
+		return t.Add(p.nextRefresh())
+	}
+	next := p.schedule.next(t)
+	if p.Jitter > 0 {
+		next = next.Add(rand.N(time.Duration(p.Jitter)))
+	}
+	return next
+}
+
+// period returns the time between two refreshes: Interval, or the time
+// between the next two scheduled refreshes
+func (p *ParspackIPRange) period() time.Duration {
+	if p.schedule == nil {
+		return p.baseInterval()
+	}
+	next := p.schedule.next(p.now())
+	return p.schedule.next(next).Sub(next)
+}
+
+// nextDue returns when the refresh after the one due at due should happen.
+// If the machine was suspended past several intervals, the missed ones are
+// coalesced into the refresh that just happened and the schedule resumes
+// at the next interval boundary, or scheduled time, after now.
+func (p *ParspackIPRange) nextDue(due, now time.Time) time.Time {
+	if p.schedule != nil {
+		if now.After(due) {
+			due = now
+		}
+		return p.nextAfter(due)
+	}
+	next := due.Add(p.nextRefresh())
+	if next.After(now) {
+		return next
+	}
+	interval := p.baseInterval()
+	missed := now.Sub(next)/interval + 1
+	return next.Add(missed * interval)
+}
+
+// failureDue returns when to refresh next after a failed refresh: after
+// InitialRetry as long as no fetch has succeeded yet, or at due otherwise.
+// A Retry-After requested by the server only ever postpones that time,
+// never brings it forward. It returns due if err is nil.
+func (p *ParspackIPRange) failureDue(due, now time.Time, err error) time.Time {
+	if err == nil {
+		return due
+	}
+	next := due
+	if p.InitialRetry > 0 && !p.hasFetched() {
+		if retry := now.Add(time.Duration(p.InitialRetry)); retry.Before(due) {
+			next = retry
+		}
+	}
+	if delay := retryAfterDelay(err); delay > 0 {
+		if later := now.Add(delay); later.After(next) {
+			p.log().Info("rate limited by server, postponing next refresh", zap.Duration("retry_after", delay))
+			next = later
+		}
+	}
+	return next
+}
+
+// readyDue returns when to refresh next after a successful refresh: after
+// InitialRetry as long as ReadyAfter needs more successes, or at due
+// otherwise
+func (p *ParspackIPRange) readyDue(due, now time.Time) time.Time {
+	p.mu.RLock()
+	confirming := p.successes < p.ReadyAfter
+	p.mu.RUnlock()
+	if p.InitialRetry > 0 && confirming {
+		if retry := now.Add(time.Duration(p.InitialRetry)); retry.Before(due) {
+			return retry
+		}
+	}
+	return due
+}
+
+// hasFetched reports whether a fetch has succeeded since Provision
+func (p *ParspackIPRange) hasFetched() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.lastFetch.IsZero()
+}
+
+// refreshLoop periodically refreshes the IP ranges
+func (p *ParspackIPRange) refreshLoop(ctx context.Context) {
+	// First time fetch, unless Provision already did it or the ranges were
+	// carried over from a previous config
+	var initErr error
+	if !p.hasFetched() {
+		if p.InitialDelay > 0 {
+			delay := p.clock().NewTimer(time.Duration(p.InitialDelay))
+			select {
+			case <-delay.C():
+			case <-ctx.Done():
+				delay.Stop()
+				return
+			}
+		}
+		if initErr = p.refresh(ctx); initErr != nil {
+			p.log().Log(p.failureLevel(), "failed to fetch initial IP ranges", zap.Error(initErr))
+		}
+	}
+
+	if p.DisableRefresh {
+		return
+	}
+
+	// Schedule from the last fetch, which may predate a reload
+	now := p.wallNow()
+	due := p.nextAfter(now)
+	p.mu.RLock()
+	if !p.lastFetch.IsZero() {
+		due = p.nextAfter(p.lastFetch.Round(0))
+	}
+	p.mu.RUnlock()
+	due = p.failureDue(due, now, initErr)
+	if initErr == nil {
+		due = p.readyDue(due, now)
+	}
+
+	// The timer only wakes the loop up to check the wall clock; sleeping
+	// at most wakeCheckInterval notices a resume from suspend quickly.
+	// Refreshes run synchronously, so a fetch outlasting the interval
+	// delays the next one instead of overlapping it, and nextDue skips the
+	// ticks it missed.
+	timer := p.clock().NewTimer(min(due.Sub(now), wakeCheckInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			now := p.wallNow()
+			if now.Before(due) {
+				timer.Reset(min(due.Sub(now), wakeCheckInterval))
+				continue
+			}
+
+			due = p.nextDue(due, now)
+			if p.isPaused() {
+				p.log().Debug("refreshing is paused, skipping scheduled refresh")
+				timer.Reset(min(due.Sub(p.wallNow()), wakeCheckInterval))
+				continue
+			}
+			if err := p.refresh(ctx); err != nil {
+				p.log().Log(p.failureLevel(), "failed to refresh IP ranges", zap.Error(err))
+				due = p.failureDue(due, p.wallNow(), err)
+			} else {
+				if p.AutoInterval {
+					// Follow the lifetime of the response just fetched
+					due = p.nextAfter(p.wallNow())
+				}
+				due = p.readyDue(due, p.wallNow())
+			}
+			timer.Reset(min(due.Sub(p.wallNow()), wakeCheckInterval))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// failureLevel returns the level of FailureLogLevel, Error by default
+func (p *ParspackIPRange) failureLevel() zapcore.Level {
+	level, err := zapcore.ParseLevel(p.FailureLogLevel)
+	if err != nil || p.FailureLogLevel == "" {
+		return zapcore.ErrorLevel
+	}
+	return level
+}
+
+// Cleanup implements caddy.CleanerUpper. When the last instance sharing a
+// fetcher is cleaned up, it cancels any in-flight fetch and waits for the
+// refresh loop to exit, so no goroutine outlives the module.
+func (p *ParspackIPRange) Cleanup() error {
+	unregisterInstance(p)
+	p.leave()
+	if p.poolKey == "" {
+		// Not provisioned through the pool
+		p.stop()
+		return nil
+	}
+	_, err := fetchers.Delete(p.poolKey)
+	return err
+}
+
+// stop cancels the refresh loop and waits for it and the other work
+// started with goTracked to exit
+func (p *ParspackIPRange) stop() {
+	p.unwatchSignal()
+	p.stopMu.Lock()
+	p.stopped = true
+	p.stopMu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+}
+
+// goTracked runs f in a goroutine that stop waits for, unless p is already
+// stopping, in which case f isn't run and goTracked returns false
+func (p *ParspackIPRange) goTracked(f func()) bool {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.wg.Go(f)
+	return true
+}
+
+// repeatableOptions are the Caddyfile options that may be given several
+// times, each occurrence adding to the previous ones
+var repeatableOptions = map[string]bool{
+	"additional":      true,
+	"additional_file": true,
+	"bootstrap":       true,
+	"exclude":         true,
+	"exclude_file":    true,
+	"fallback":        true,
+	"header":          true,
+	"merge":           true,
+	"resolve":         true,
+	"transform":       true,
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+func (p *ParspackIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip module name
+
+	// No same-line options are supported
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	// Other options may only be given once, rather than the last one
+	// silently winning
+	seen := make(map[string]bool)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if !repeatableOptions[d.Val()] {
+			if seen[d.Val()] {
+				return d.Errf("duplicate %s option", d.Val())
+			}
+			seen[d.Val()] = true
+		}
+
+		switch d.Val() {
 		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			// interval auto [<fallback>]
+			if d.Val() == "auto" {
+				p.AutoInterval = true
+				if !d.NextArg() {
+					break
+				}
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid interval duration: %v", err)
+			}
+			p.Interval = caddy.Duration(dur)
+
+		case "min_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid min_interval duration: %v", err)
+			}
+			p.MinInterval = caddy.Duration(dur)
+
+		case "max_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_interval duration: %v", err)
+			}
+			p.MaxInterval = caddy.Duration(dur)
+
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid timeout duration: %v", err)
+			}
+			p.Timeout = caddy.Duration(dur)
+
+		case "schedule":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.Schedule = strings.Join(args, " ")
+
+		case "refresh":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "on":
+				p.DisableRefresh = false
+			case "off":
+				p.DisableRefresh = true
+			default:
+				return d.Errf("invalid refresh value %q: must be on or off", d.Val())
+			}
+
+		case "jitter":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			dur, err := caddy.ParseDuration(d.Val())
 			if err != nil {
-				return d.Errf("invalid interval duration: %v", err)
+				return d.Errf("invalid jitter duration: %v", err)
 			}
-			p.Interval = caddy.Duration(dur)
+			p.Jitter = caddy.Duration(dur)
 
-		case "timeout":
+		case "initial_delay":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			dur, err := caddy.ParseDuration(d.Val())
 			if err != nil {
-				return d.Errf("invalid timeout duration: %v", err)
+				return d.Errf("invalid initial_delay duration: %v", err)
 			}
-			p.Timeout = caddy.Duration(dur)
+			p.InitialDelay = caddy.Duration(dur)
+
+		case "initial_retry":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid initial_retry duration: %v", err)
+			}
+			p.InitialRetry = caddy.Duration(dur)
+
+		case "max_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_retries value: %v", err)
+			}
+			// An absent option already means the default, so 0 can
+			// disable retries like -1
+			if n == 0 {
+				n = -1
+			}
+			p.MaxRetries = n
+
+		case "max_parse_warnings":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_parse_warnings value: %v", err)
+			}
+			// As with max_retries, 0 only logs the summary like -1
+			if n == 0 {
+				n = -1
+			}
+			p.MaxParseWarnings = n
+
+		case "failure_log_level":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch level := strings.ToLower(d.Val()); level {
+			case "error", "warn", "debug":
+				p.FailureLogLevel = level
+			default:
+				return d.Errf("invalid failure_log_level value %q: must be error, warn or debug", d.Val())
+			}
+
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case formatAuto, formatText, formatJSON:
+				p.Format = d.Val()
+			default:
+				return d.Errf("invalid format value %q: must be auto, text or json", d.Val())
+			}
+
+		case "max_stale":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_stale duration: %v", err)
+			}
+			p.MaxStale = caddy.Duration(dur)
+
+		case "fail_closed":
+			p.FailClosed = true
+			if d.NextArg() {
+				failClosed, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid fail_closed value: %v", err)
+				}
+				p.FailClosed = failClosed
+			}
+
+		case "refresh_signal":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.RefreshSignal = d.Val()
+
+		case "static_only":
+			p.StaticOnly = true
+			if d.NextArg() {
+				staticOnly, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid static_only value: %v", err)
+				}
+				p.StaticOnly = staticOnly
+			}
+
+		case "on_error":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case onErrorKeep, onErrorClear:
+				p.OnError = d.Val()
+			default:
+				return d.Errf("invalid on_error value %q: must be keep or clear", d.Val())
+			}
+
+		case "retry_backoff":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid retry_backoff duration: %v", err)
+			}
+			p.RetryBackoff = caddy.Duration(dur)
+
+		case "retry_jitter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case retryJitterNone, retryJitterEqual, retryJitterFull:
+				p.RetryJitter = d.Val()
+			default:
+				return d.Errf("invalid retry_jitter value %q: must be none, equal or full", d.Val())
+			}
+
+		case "file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.File = d.Val()
+
+		case "url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.URL = d.Val()
+
+		case "cache_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.CacheFile = d.Val()
+
+		case "cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid cache_ttl duration: %v", err)
+			}
+			p.CacheTTL = caddy.Duration(dur)
+
+		case "wait_for_first_fetch":
+			p.WaitForFirstFetch = true
+			if d.NextArg() {
+				wait, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid wait_for_first_fetch value: %v", err)
+				}
+				p.WaitForFirstFetch = wait
+			}
+
+		case "additional":
+			p.Additional = append(p.Additional, d.RemainingArgs()...)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				p.Additional = append(p.Additional, d.Val())
+				p.Additional = append(p.Additional, d.RemainingArgs()...)
+			}
+
+		case "exclude":
+			p.Exclude = append(p.Exclude, d.RemainingArgs()...)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				p.Exclude = append(p.Exclude, d.Val())
+				p.Exclude = append(p.Exclude, d.RemainingArgs()...)
+			}
+
+		case "additional_file":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.AdditionalFiles = append(p.AdditionalFiles, args...)
+
+		case "exclude_file":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.ExcludeFiles = append(p.ExcludeFiles, args...)
+
+		case "bootstrap":
+			p.Bootstrap = append(p.Bootstrap, d.RemainingArgs()...)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				p.Bootstrap = append(p.Bootstrap, d.Val())
+				p.Bootstrap = append(p.Bootstrap, d.RemainingArgs()...)
+			}
+
+		case "bootstrap_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.BootstrapFile = d.Val()
+
+		case "basic_auth":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			p.BasicAuth = &BasicAuth{Username: args[0], Password: args[1]}
+
+		case "bearer_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.BearerToken = d.Val()
+
+		case "user_agent":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.UserAgent = d.Val()
+
+		case "method":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Method = strings.ToUpper(d.Val())
+
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if p.Headers == nil {
+				p.Headers = make(http.Header)
+			}
+			p.Headers.Add(args[0], args[1])
+
+		case "proxy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Proxy = d.Val()
+
+		case "idle_conn_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid idle_conn_timeout duration: %v", err)
+			}
+			p.IdleConnTimeout = caddy.Duration(dur)
+
+		case "max_idle_conns":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_idle_conns value: %v", err)
+			}
+			p.MaxIdleConns = n
+
+		case "tls_handshake_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid tls_handshake_timeout duration: %v", err)
+			}
+			p.TLSHandshakeTimeout = caddy.Duration(dur)
+
+		case "http_version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case "1.1", "2":
+				p.HTTPVersion = d.Val()
+			default:
+				return d.Errf("invalid http_version value %q: must be 1.1 or 2", d.Val())
+			}
+
+		case "ca_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.CAFile = d.Val()
+
+		case "client_cert":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			p.ClientCertFile, p.ClientKeyFile = args[0], args[1]
+
+		case "insecure_skip_verify":
+			p.InsecureSkipVerify = true
+			if d.NextArg() {
+				skip, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid insecure_skip_verify value: %v", err)
+				}
+				p.InsecureSkipVerify = skip
+			}
+
+		case "max_body_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_body_size value: %v", err)
+			}
+			p.MaxBodySize = int64(size)
+
+		case "fallback":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.Fallbacks = append(p.Fallbacks, args...)
+
+		case "merge":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			m := MergeSource{URL: args[0]}
+			if len(args) == 2 {
+				m.Format = args[1]
+			}
+			p.Merge = append(p.Merge, m)
+
+		case "max_ranges":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_ranges value: %v", err)
+			}
+			p.MaxRanges = n
+
+		case "min_prefix_len", "max_prefix_len":
+			option := d.Val()
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			lens := make([]int, len(args))
+			for i, arg := range args {
+				n, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("invalid %s value: %v", option, err)
+				}
+				lens[i] = n
+			}
+			v4, v6 := &p.MinPrefixLen, &p.MinPrefixLenIPv6
+			if option == "max_prefix_len" {
+				v4, v6 = &p.MaxPrefixLen, &p.MaxPrefixLenIPv6
+			}
+			*v4 = lens[0]
+			if len(lens) == 2 {
+				*v6 = lens[1]
+			}
+
+		case "ready_after":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ready_after value: %v", err)
+			}
+			p.ReadyAfter = n
+
+		case "confirm_changes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid confirm_changes value: %v", err)
+			}
+			p.ConfirmChanges = n
+
+		case "min_ratio":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ratio, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("invalid min_ratio value: %v", err)
+			}
+			p.MinRatio = ratio
+
+		case "collapse":
+			p.Collapse = true
+			if d.NextArg() {
+				collapse, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid collapse value: %v", err)
+				}
+				p.Collapse = collapse
+			}
+
+		case "strict":
+			p.Strict = true
+			if d.NextArg() {
+				strict, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid strict value: %v", err)
+				}
+				p.Strict = strict
+			}
+
+		case "drop_private":
+			p.DropPrivate = true
+			if d.NextArg() {
+				drop, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid drop_private value: %v", err)
+				}
+				p.DropPrivate = drop
+			}
+
+		case "gzip":
+			p.Gzip = true
+			if d.NextArg() {
+				gz, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid gzip value: %v", err)
+				}
+				p.Gzip = gz
+			}
+
+		case "notify_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.NotifyURL = d.Val()
+
+		case "notify_on":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case notifyAlways, notifyChange, notifyError:
+				p.NotifyOn = d.Val()
+			default:
+				return d.Errf("invalid notify_on value %q: must be always, change or error", d.Val())
+			}
+
+		case "checksum_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.ChecksumURL = d.Val()
+
+		case "ipv6":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			enabled, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6 value: %v", err)
+			}
+			p.IPv6 = &enabled
+
+		case "family":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case familyV4, familyV6, familyBoth:
+				p.Family = d.Val()
+			default:
+				return d.Errf("invalid family value %q: must be v4, v6 or both", d.Val())
+			}
+
+		case "resolve":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			p.Resolve = append(p.Resolve, args...)
+
+		case "transform":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, transformersNamespace+"."+name)
+			if err != nil {
+				return err
+			}
+			p.TransformersRaw = append(p.TransformersRaw, caddyconfig.JSONModuleObject(unm, "transformer", name, nil))
 
 		default:
 			return d.ArgErr()
@@ -212,6 +2509,7 @@ func (p *ParspackIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 // Interface guards
 var (
 	_ caddy.Provisioner       = (*ParspackIPRange)(nil)
+	_ caddy.Validator         = (*ParspackIPRange)(nil)
 	_ caddy.CleanerUpper      = (*ParspackIPRange)(nil)
 	_ caddyfile.Unmarshaler   = (*ParspackIPRange)(nil)
 	_ caddyhttp.IPRangeSource = (*ParspackIPRange)(nil)
@@ -1,9 +1,22 @@
 package parspackip
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestUnmarshalCaddyfile(t *testing.T) {
@@ -32,6 +45,244 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "jitter",
+			input: `parspack {
+				jitter 5m
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if time.Duration(p.Jitter) != 5*time.Minute {
+					return fmt.Errorf("unexpected jitter: %v", time.Duration(p.Jitter))
+				}
+				return nil
+			},
+		},
+		{
+			name: "ipv6 disabled",
+			input: `parspack {
+				ipv6 false
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if p.IPv6 == nil || *p.IPv6 {
+					return fmt.Errorf("expected ipv6 to be disabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "refresh off",
+			input: `parspack {
+				refresh off
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if !p.DisableRefresh {
+					return fmt.Errorf("expected refresh to be disabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid refresh value",
+			input: `parspack {
+				refresh sometimes
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "retry options",
+			input: `parspack {
+				max_retries 5
+				retry_backoff 2s
+				retry_jitter equal
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if p.MaxRetries != 5 {
+					return fmt.Errorf("unexpected max_retries: %d", p.MaxRetries)
+				}
+				if time.Duration(p.RetryBackoff) != 2*time.Second {
+					return fmt.Errorf("unexpected retry_backoff: %v", time.Duration(p.RetryBackoff))
+				}
+				if p.RetryJitter != retryJitterEqual {
+					return fmt.Errorf("unexpected retry_jitter: %q", p.RetryJitter)
+				}
+				return nil
+			},
+		},
+		{
+			name: "max_retries 0 disables retries",
+			input: `parspack {
+				max_retries 0
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if err := p.prepare(); err != nil {
+					return err
+				}
+				if p.MaxRetries != -1 {
+					return fmt.Errorf("unexpected max_retries: %d, want -1", p.MaxRetries)
+				}
+				return nil
+			},
+		},
+		{
+			name: "max_parse_warnings 0 logs only the summary",
+			input: `parspack {
+				max_parse_warnings 0
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if err := p.prepare(); err != nil {
+					return err
+				}
+				core, logs := observer.New(zap.WarnLevel)
+				p.logger = zap.New(core)
+				if _, err := p.parseIPRanges("bad1\nbad2\n185.8.172.0/22\n"); err != nil {
+					return err
+				}
+				if n := logs.Len(); n != 1 || logs.FilterMessage("skipped 2 unparseable lines").Len() != 1 {
+					return fmt.Errorf("got %d log entries, want only the summary", n)
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid max_retries",
+			input: `parspack {
+				max_retries many
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "max body size",
+			input: `parspack {
+				max_body_size 1MiB
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if p.MaxBodySize != 1<<20 {
+					return fmt.Errorf("unexpected max_body_size: %d", p.MaxBodySize)
+				}
+				return nil
+			},
+		},
+		{
+			name: "custom url",
+			input: `parspack {
+				url https://mirror.example.com/cdnips.txt
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if p.URL != "https://mirror.example.com/cdnips.txt" {
+					return fmt.Errorf("unexpected url: %s", p.URL)
+				}
+				return nil
+			},
+		},
+		{
+			name: "fallback urls",
+			input: `parspack {
+				fallback https://a.example.com/list.txt https://b.example.com/list.txt
+				fallback https://c.example.com/list.txt
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if len(p.Fallbacks) != 3 || p.Fallbacks[2] != "https://c.example.com/list.txt" {
+					return fmt.Errorf("unexpected fallbacks: %v", p.Fallbacks)
+				}
+				return nil
+			},
+		},
+		{
+			name: "url without value",
+			input: `parspack {
+				url
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "cache file",
+			input: `parspack {
+				cache_file /var/lib/caddy/parspack.txt
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if p.CacheFile != "/var/lib/caddy/parspack.txt" {
+					return fmt.Errorf("unexpected cache_file: %s", p.CacheFile)
+				}
+				return nil
+			},
+		},
+		{
+			name: "additional ranges",
+			input: `parspack {
+				additional 10.0.0.0/8 192.168.0.0/16
+				additional {
+					172.16.0.0/12
+					2001:db8::/32
+				}
+			}`,
+			check: func(p *ParspackIPRange) error {
+				want := []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12", "2001:db8::/32"}
+				if len(p.Additional) != len(want) {
+					return fmt.Errorf("unexpected additional ranges: %v", p.Additional)
+				}
+				for i := range want {
+					if p.Additional[i] != want[i] {
+						return fmt.Errorf("additional range %d = %s, want %s", i, p.Additional[i], want[i])
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "exclude ranges",
+			input: `parspack {
+				exclude 185.8.172.0/24
+				exclude {
+					2a0e:1c80::/48
+				}
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if !slices.Equal(p.Exclude, []string{"185.8.172.0/24", "2a0e:1c80::/48"}) {
+					return fmt.Errorf("unexpected exclude ranges: %v", p.Exclude)
+				}
+				return nil
+			},
+		},
+		{
+			name: "wait for first fetch",
+			input: `parspack {
+				wait_for_first_fetch
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if !p.WaitForFirstFetch {
+					return fmt.Errorf("expected wait_for_first_fetch to be enabled")
+				}
+				return nil
+			},
+		},
+		{
+			name: "invalid ipv6 value",
+			input: `parspack {
+				ipv6 maybe
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate interval",
+			input: `parspack {
+				interval 1h
+				interval 2h
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "repeated fallback",
+			input: `parspack {
+				fallback https://a.example.com/cdnips.txt
+				fallback https://b.example.com/cdnips.txt
+			}`,
+			check: func(p *ParspackIPRange) error {
+				if len(p.Fallbacks) != 2 {
+					return fmt.Errorf("expected 2 fallbacks, got %v", p.Fallbacks)
+				}
+				return nil
+			},
+		},
 		{
 			name:    "invalid directive",
 			input:   `parspack { invalid_option }`,
@@ -56,3 +307,581 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestPrepareMinInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     func(*ParspackIPRange) caddy.Duration
+		wantWarn bool
+	}{
+		{
+			name:     "interval below minimum",
+			input:    `parspack { interval 1s }`,
+			want:     func(p *ParspackIPRange) caddy.Duration { return p.Interval },
+			wantWarn: true,
+		},
+		{
+			name:  "interval at minimum",
+			input: `parspack { interval 1m }`,
+			want:  func(p *ParspackIPRange) caddy.Duration { return p.Interval },
+		},
+		{
+			name: "min_interval below minimum",
+			input: `parspack {
+				interval auto
+				min_interval 1s
+			}`,
+			want: func(p *ParspackIPRange) caddy.Duration { return p.MinInterval },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			p := &ParspackIPRange{logger: zap.New(core)}
+			if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+				t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+			}
+			if err := p.prepare(); err != nil {
+				t.Fatalf("prepare() error = %v", err)
+			}
+			if got := time.Duration(tt.want(p)); got != minInterval {
+				t.Errorf("got %v, want %v", got, minInterval)
+			}
+			if warned := logs.FilterMessage("interval is below the minimum, clamping").Len() == 1; warned != tt.wantWarn {
+				t.Errorf("clamping warning logged = %v, want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestNextRefreshJitter(t *testing.T) {
+	p := &ParspackIPRange{
+		Interval: caddy.Duration(time.Hour),
+		Jitter:   caddy.Duration(10 * time.Minute),
+	}
+	for i := 0; i < 100; i++ {
+		d := p.nextRefresh()
+		if d < time.Hour || d >= time.Hour+10*time.Minute {
+			t.Fatalf("nextRefresh() = %v, want within [1h, 1h10m)", d)
+		}
+	}
+
+	p.Jitter = 0
+	if d := p.nextRefresh(); d != time.Hour {
+		t.Errorf("nextRefresh() without jitter = %v, want 1h", d)
+	}
+}
+
+func TestNextDue(t *testing.T) {
+	p := &ParspackIPRange{Interval: caddy.Duration(time.Hour)}
+	due := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{name: "on time", now: due.Add(time.Second), want: due.Add(time.Hour)},
+		{name: "late within interval", now: due.Add(30 * time.Minute), want: due.Add(time.Hour)},
+		{name: "one missed", now: due.Add(90 * time.Minute), want: due.Add(2 * time.Hour)},
+		{name: "suspended overnight", now: due.Add(10*time.Hour + time.Minute), want: due.Add(11 * time.Hour)},
+		{name: "exactly on boundary", now: due.Add(2 * time.Hour), want: due.Add(3 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.nextDue(due, tt.now); !got.Equal(tt.want) {
+				t.Errorf("nextDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *ParspackIPRange {
+		return &ParspackIPRange{
+			URL:      ipv4URL,
+			Interval: caddy.Duration(time.Hour),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*ParspackIPRange)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(p *ParspackIPRange) {}},
+		{name: "negative timeout", modify: func(p *ParspackIPRange) { p.Timeout = -1 }, wantErr: true},
+		{name: "interval below timeout", modify: func(p *ParspackIPRange) {
+			p.Interval = caddy.Duration(time.Minute)
+			p.Timeout = caddy.Duration(2 * time.Minute)
+		}, wantErr: true},
+		{name: "interval equal to timeout", modify: func(p *ParspackIPRange) {
+			p.Interval = caddy.Duration(time.Minute)
+			p.Timeout = caddy.Duration(time.Minute)
+		}, wantErr: true},
+		{name: "zero interval", modify: func(p *ParspackIPRange) { p.Interval = 0 }, wantErr: true},
+		{name: "negative jitter", modify: func(p *ParspackIPRange) { p.Jitter = -1 }, wantErr: true},
+		{name: "invalid max_retries", modify: func(p *ParspackIPRange) { p.MaxRetries = -2 }, wantErr: true},
+		{name: "fail_closed without max_stale", modify: func(p *ParspackIPRange) { p.FailClosed = true }, wantErr: true},
+		{name: "fail_closed", modify: func(p *ParspackIPRange) {
+			p.FailClosed = true
+			p.MaxStale = caddy.Duration(24 * time.Hour)
+		}},
+		{name: "invalid retry_jitter", modify: func(p *ParspackIPRange) { p.RetryJitter = "random" }, wantErr: true},
+		{name: "min_ratio above one", modify: func(p *ParspackIPRange) { p.MinRatio = 1.5 }, wantErr: true},
+		{name: "ftp url", modify: func(p *ParspackIPRange) { p.URL = "ftp://example.com/list.txt" }, wantErr: true},
+		{name: "url without host", modify: func(p *ParspackIPRange) { p.URL = "https:///list.txt" }, wantErr: true},
+		{name: "invalid fallback", modify: func(p *ParspackIPRange) { p.Fallbacks = []string{"mirror.example.com"} }, wantErr: true},
+		{name: "malformed url", modify: func(p *ParspackIPRange) { p.URL = "http://[::1" }, wantErr: true},
+		{name: "notify_url", modify: func(p *ParspackIPRange) {
+			p.NotifyURL = "https://hooks.example.com/parspack"
+			p.NotifyOn = notifyError
+		}},
+		{name: "invalid notify_url", modify: func(p *ParspackIPRange) { p.NotifyURL = "hooks.example.com" }, wantErr: true},
+		{name: "invalid notify_on", modify: func(p *ParspackIPRange) {
+			p.NotifyURL = "https://hooks.example.com/parspack"
+			p.NotifyOn = "never"
+		}, wantErr: true},
+		{name: "notify_on without notify_url", modify: func(p *ParspackIPRange) { p.NotifyOn = notifyChange }, wantErr: true},
+		{name: "basic auth and bearer token", modify: func(p *ParspackIPRange) {
+			p.BasicAuth = &BasicAuth{Username: "user", Password: "pass"}
+			p.BearerToken = "token"
+		}, wantErr: true},
+		{name: "initial_delay with wait_for_first_fetch", modify: func(p *ParspackIPRange) {
+			p.InitialDelay = caddy.Duration(time.Second)
+			p.WaitForFirstFetch = true
+		}, wantErr: true},
+		{name: "interval and schedule", modify: func(p *ParspackIPRange) { p.Schedule = "03:00" }, wantErr: true},
+		{name: "schedule", modify: func(p *ParspackIPRange) {
+			p.Interval = 0
+			p.Schedule = "03:00"
+		}},
+		{name: "schedule never matching", modify: func(p *ParspackIPRange) {
+			p.Interval = 0
+			p.Schedule = "0 3 30 2 *"
+		}, wantErr: true},
+		{name: "interval auto", modify: func(p *ParspackIPRange) {
+			p.AutoInterval = true
+			p.MinInterval = caddy.Duration(time.Minute)
+			p.MaxInterval = caddy.Duration(time.Hour)
+		}},
+		{name: "min_interval above max_interval", modify: func(p *ParspackIPRange) {
+			p.AutoInterval = true
+			p.MinInterval = caddy.Duration(2 * time.Hour)
+			p.MaxInterval = caddy.Duration(time.Hour)
+		}, wantErr: true},
+		{name: "min_interval without interval auto", modify: func(p *ParspackIPRange) {
+			p.MinInterval = caddy.Duration(time.Minute)
+		}, wantErr: true},
+		{name: "ipv4 prefix length out of range", modify: func(p *ParspackIPRange) { p.MaxPrefixLen = 33 }, wantErr: true},
+		{name: "ipv6 prefix length bounds inverted", modify: func(p *ParspackIPRange) { p.MinPrefixLenIPv6, p.MaxPrefixLenIPv6 = 64, 48 }, wantErr: true},
+		{name: "only a minimum prefix length", modify: func(p *ParspackIPRange) { p.MinPrefixLen = 8 }},
+		{name: "unknown family", modify: func(p *ParspackIPRange) { p.Family = "ipv4" }, wantErr: true},
+		{name: "family v6 without the IPv6 list", modify: func(p *ParspackIPRange) { p.Family, p.IPv6 = familyV6, new(bool) }, wantErr: true},
+		{name: "negative ready_after", modify: func(p *ParspackIPRange) { p.ReadyAfter = -1 }, wantErr: true},
+		{name: "ready_after without refreshing", modify: func(p *ParspackIPRange) { p.ReadyAfter, p.DisableRefresh = 2, true }, wantErr: true},
+		{name: "negative confirm_changes", modify: func(p *ParspackIPRange) { p.ConfirmChanges = -1 }, wantErr: true},
+		{name: "unknown http_version", modify: func(p *ParspackIPRange) { p.HTTPVersion = "3" }, wantErr: true},
+		{name: "http_version 2", modify: func(p *ParspackIPRange) { p.HTTPVersion = "2" }},
+		{name: "http_version 2 with an http url", modify: func(p *ParspackIPRange) {
+			p.HTTPVersion, p.URL = "2", "http://mirror.example.com/cdnips.txt"
+		}, wantErr: true},
+		{name: "http_version 2 with an http merged list", modify: func(p *ParspackIPRange) {
+			p.HTTPVersion = "2"
+			p.Merge = []MergeSource{{URL: "http://cdn.example.com/ips.txt"}}
+		}, wantErr: true},
+		{name: "unknown failure_log_level", modify: func(p *ParspackIPRange) { p.FailureLogLevel = "info" }, wantErr: true},
+		{name: "unknown on_error", modify: func(p *ParspackIPRange) { p.OnError = "ignore" }, wantErr: true},
+		{name: "unknown format", modify: func(p *ParspackIPRange) { p.Format = "yaml" }, wantErr: true},
+		{name: "post method", modify: func(p *ParspackIPRange) { p.Method = http.MethodPost }},
+		{name: "head method", modify: func(p *ParspackIPRange) { p.Method = http.MethodHead }, wantErr: true},
+		{name: "lowercase method", modify: func(p *ParspackIPRange) { p.Method = "post" }, wantErr: true},
+		{name: "header name with colon", modify: func(p *ParspackIPRange) {
+			p.Headers = http.Header{"X-Api-Key:": {"secret"}}
+		}, wantErr: true},
+		{name: "header value with newline", modify: func(p *ParspackIPRange) {
+			p.Headers = http.Header{"X-Api-Key": {"secret\r\nX-Injected: 1"}}
+		}, wantErr: true},
+		{name: "static_only", modify: func(p *ParspackIPRange) {
+			p.StaticOnly = true
+			p.Additional = []string{"10.0.0.0/8"}
+		}},
+		{name: "static_only without additional", modify: func(p *ParspackIPRange) { p.StaticOnly = true }, wantErr: true},
+		{name: "static_only with resolve", modify: func(p *ParspackIPRange) {
+			p.StaticOnly = true
+			p.Additional = []string{"10.0.0.0/8"}
+			p.Resolve = []string{"cdn.example.com"}
+		}, wantErr: true},
+		{name: "client cert without key", modify: func(p *ParspackIPRange) { p.ClientCertFile = "client.pem" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid()
+			tt.modify(p)
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProvisionRejectsBeforeFetching(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		modify func(*ParspackIPRange)
+	}{
+		{name: "fail_closed without max_stale", modify: func(p *ParspackIPRange) { p.FailClosed = true }},
+		{name: "basic_auth and bearer_token", modify: func(p *ParspackIPRange) {
+			p.BasicAuth = &BasicAuth{Username: "user", Password: "secret"}
+			p.BearerToken = "token"
+		}},
+		{name: "interval not above timeout", modify: func(p *ParspackIPRange) {
+			p.Interval = caddy.Duration(time.Minute)
+			p.Timeout = caddy.Duration(time.Minute)
+		}},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ParspackIPRange{URL: srv.URL, WaitForFirstFetch: true, logger: zap.NewNop()}
+			tt.modify(p)
+			if err := p.Provision(ctx); err == nil {
+				p.Cleanup()
+				t.Fatal("Provision() succeeded, want an error")
+			}
+			if n := requests.Load(); n != 0 {
+				t.Errorf("got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestExpandURL(t *testing.T) {
+	t.Setenv("PARSPACK_TEST_MIRROR", "mirror.example.com")
+	t.Setenv("PARSPACK_TEST_EMPTY", "")
+	repl := caddy.NewReplacer()
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "https://parspack.com/cdnips.txt", want: "https://parspack.com/cdnips.txt"},
+		{raw: "https://{env.PARSPACK_TEST_MIRROR}/cdnips.txt", want: "https://mirror.example.com/cdnips.txt"},
+		{raw: " {env.PARSPACK_TEST_EMPTY} ", wantErr: true},
+		{raw: "https://{unknown.placeholder}/cdnips.txt", want: "https://{unknown.placeholder}/cdnips.txt"},
+	}
+
+	for _, tt := range tests {
+		got, err := expandURL(repl, tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandURL(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	// Placeholders that aren't known at provisioning time are left as is
+	// and rejected by Validate
+	if err := validateURL("https://{unknown.placeholder}/cdnips.txt"); err == nil {
+		t.Error("expected unexpanded placeholder to fail validation")
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "https://parspack.com/cdnips.txt", want: "https://parspack.com/cdnips.txt"},
+		{raw: "HTTPS://parspack.com/cdnips.txt", want: "https://parspack.com/cdnips.txt"},
+		{raw: "https://آینه.example/cdnips.txt", want: "https://xn--hgb6ed44c.example/cdnips.txt"},
+		{raw: "https://bücher.example:8443/ip list.txt", want: "https://xn--bcher-kva.example:8443/ip%20list.txt"},
+		{raw: "https://mirror.example.com/cdnips%20v4.txt", want: "https://mirror.example.com/cdnips%20v4.txt"},
+		{raw: "http://[::1]:8080/cdnips.txt", want: "http://[::1]:8080/cdnips.txt"},
+		{raw: "http://[::1/cdnips.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeURL(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseIPRanges(t *testing.T) {
+	p := &ParspackIPRange{logger: zap.NewNop()}
+	text := `# ParsPack CDN
+185.8.172.0/22 # tehran pop
+
+1.2.3.0-1.2.3.255	# span
+not-an-ip
+5.6.7.8-5.6.7.1
+9.9.9.9
+2a0e:1c80::1
+1.2.3.4/33
+`
+	ranges, err := p.parseIPRanges(text)
+	if err != nil {
+		t.Fatalf("parseIPRanges() error = %v", err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("185.8.172.0/22"),
+		netip.MustParsePrefix("1.2.3.0/24"),
+		netip.MustParsePrefix("9.9.9.9/32"),
+		netip.MustParsePrefix("2a0e:1c80::1/128"),
+	}
+	if !slices.Equal(ranges, want) {
+		t.Errorf("parseIPRanges() = %v, want %v", ranges, want)
+	}
+}
+
+func TestParseIPRangesLineEndings(t *testing.T) {
+	want := prefixes("185.8.172.0/22", "195.248.240.0/22")
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "crlf", text: "185.8.172.0/22\r\n195.248.240.0/22\r\n"},
+		{name: "bare cr", text: "185.8.172.0/22\r195.248.240.0/22\r"},
+		{name: "bom", text: "\ufeff185.8.172.0/22\n195.248.240.0/22\n"},
+		{name: "bom and crlf", text: "\ufeff185.8.172.0/22\r\n195.248.240.0/22"},
+		{name: "bom before comment", text: "\ufeff# ParsPack CDN\r\n185.8.172.0/22\r\n195.248.240.0/22\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			p := &ParspackIPRange{MaxParseWarnings: defaultMaxParseWarnings, logger: zap.New(core)}
+			ranges, err := p.parseIPRanges(tt.text)
+			if err != nil {
+				t.Fatalf("parseIPRanges() error = %v", err)
+			}
+			if !slices.Equal(ranges, want) {
+				t.Errorf("parseIPRanges() = %v, want %v", ranges, want)
+			}
+			if logs.Len() != 0 {
+				t.Errorf("unexpected warnings: %v", logs.All())
+			}
+		})
+	}
+}
+
+func TestParseIPRangesPrefixLen(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	p := &ParspackIPRange{
+		MinPrefixLen:     8,
+		MaxPrefixLen:     24,
+		MinPrefixLenIPv6: 16,
+		logger:           zap.New(core),
+	}
+	ranges, err := p.parseIPRanges("0.0.0.0/0\n185.8.172.0/22\n185.8.172.10\n::/0\n2a0e:1c80::/32\n2a0e:1c80::1\n")
+	if err != nil {
+		t.Fatalf("parseIPRanges() error = %v", err)
+	}
+	if want := prefixes("185.8.172.0/22", "2a0e:1c80::/32", "2a0e:1c80::1/128"); !slices.Equal(ranges, want) {
+		t.Errorf("parseIPRanges() = %v, want %v", ranges, want)
+	}
+	if n := logs.FilterMessage("dropping IP range outside the allowed prefix lengths").Len(); n != 3 {
+		t.Errorf("got %d logged drops, want 3", n)
+	}
+
+	d := caddyfile.NewTestDispenser(`parspack {
+		min_prefix_len 8 16
+		max_prefix_len 24
+	}`)
+	p = new(ParspackIPRange)
+	if err := p.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if p.MinPrefixLen != 8 || p.MinPrefixLenIPv6 != 16 || p.MaxPrefixLen != 24 || p.MaxPrefixLenIPv6 != 0 {
+		t.Errorf("prefix length bounds = %d-%d, IPv6 %d-%d", p.MinPrefixLen, p.MaxPrefixLen, p.MinPrefixLenIPv6, p.MaxPrefixLenIPv6)
+	}
+}
+
+func TestParseIPRangesDropPrivate(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	p := &ParspackIPRange{DropPrivate: true, logger: zap.New(core)}
+	ranges, err := p.parseIPRanges("185.8.172.0/22\n10.0.0.0/8\n192.168.1.1\n172.16.0.0-172.16.1.255\nfd00::/8\n2a0e:1c80::/32\n")
+	if err != nil {
+		t.Fatalf("parseIPRanges() error = %v", err)
+	}
+	if want := prefixes("185.8.172.0/22", "2a0e:1c80::/32"); !slices.Equal(ranges, want) {
+		t.Errorf("parseIPRanges() = %v, want %v", ranges, want)
+	}
+	if n := logs.FilterMessage("dropping private or reserved IP range").Len(); n != 4 {
+		t.Errorf("got %d logged drops, want 4", n)
+	}
+}
+
+func TestListVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "updated", text: "# updated 2024-01-01\n185.8.172.0/22\n", want: "2024-01-01"},
+		{name: "after other comments", text: "\ufeff# ParsPack CDN\r\n# Updated: 2024-01-01 12:00 UTC\r\n185.8.172.0/22\r\n", want: "2024-01-01 12:00 UTC"},
+		{name: "no header", text: "185.8.172.0/22\n", want: ""},
+		{name: "unrecognized comment", text: "# ParsPack CDN\n185.8.172.0/22\n", want: ""},
+		{name: "below the first range", text: "185.8.172.0/22\n# updated 2024-01-01\n", want: ""},
+		{name: "no date", text: "# updated\n185.8.172.0/22\n", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := listVersion(tt.text)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("listVersion() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPRangesWarningCap(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		wantEntries int
+	}{
+		{name: "below cap", max: 10, wantEntries: 3},
+		{name: "capped", max: 2, wantEntries: 3},
+		{name: "summary only", max: -1, wantEntries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			p := &ParspackIPRange{MaxParseWarnings: tt.max, logger: zap.New(core)}
+			if _, err := p.parseIPRanges("bad1\nbad2\n185.8.172.0/22\nbad3\n"); err != nil {
+				t.Fatalf("parseIPRanges() error = %v", err)
+			}
+			if n := logs.Len(); n != tt.wantEntries {
+				t.Errorf("got %d log entries, want %d", n, tt.wantEntries)
+			}
+			summaries := logs.FilterMessage("skipped 3 unparseable lines").Len()
+			if wantSummary := tt.max < 3; (summaries == 1) != wantSummary {
+				t.Errorf("got %d summary entries, want summary %v", summaries, wantSummary)
+			}
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	input := `parspack {
+		interval auto 2h
+		min_interval 10m
+		max_interval 12h
+		timeout 30s
+		jitter 5m
+		schedule 30 3 * * 1-5
+		initial_delay 10s
+		initial_retry 1m
+		ready_after 3
+		refresh off
+		max_retries 5
+		max_parse_warnings 3
+		failure_log_level warn
+		notify_url https://hooks.example.com/parspack
+		notify_on change
+		format json
+		strict
+		transform test_ipv4_only
+		resolve cdn.example.com
+		max_stale 24h
+		fail_closed
+		on_error clear
+		retry_backoff 2s
+		retry_jitter none
+		url https://mirror.example.com/cdnips.txt
+		fallback https://parspack.com/cdnips.txt
+		merge https://www.cloudflare.com/ips-v4 text
+		file /etc/caddy/cdnips.txt
+		checksum_url https://mirror.example.com/cdnips.txt.sha256
+		cache_file /var/lib/caddy/parspack.txt
+		cache_ttl 48h
+		wait_for_first_fetch
+		static_only
+		refresh_signal SIGHUP
+		user_agent my-agent/1.0
+		method post
+		header X-Api-Key {env.PARSPACK_API_KEY}
+		header Accept text/plain
+		basic_auth parspack {env.PARSPACK_PASSWORD}
+		bearer_token {env.PARSPACK_TOKEN}
+		proxy socks5://127.0.0.1:1080
+		idle_conn_timeout 30s
+		max_idle_conns 2
+		tls_handshake_timeout 5s
+		http_version 1.1
+		ca_file /etc/caddy/mirror-ca.pem
+		client_cert /etc/caddy/client.pem /etc/caddy/client-key.pem
+		insecure_skip_verify
+		max_body_size 1MiB
+		min_ratio 0.5
+		max_ranges 5000
+		confirm_changes 3
+		min_prefix_len 8 16
+		max_prefix_len 32 128
+		drop_private
+		gzip
+		collapse
+		additional 10.0.0.0/8
+		bootstrap 185.8.172.0/22
+		bootstrap_file /etc/caddy/parspack-baseline.txt
+		exclude 185.8.172.0/24
+		additional_file /etc/caddy/parspack-extra.txt
+		exclude_file /etc/caddy/parspack-exclude.txt
+		ipv6 false
+		family v4
+	}`
+
+	p := &ParspackIPRange{}
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	decoded := &ParspackIPRange{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(p, decoded) {
+		t.Errorf("round trip mismatch:\n got  %+v\n want %+v\n json %s", decoded, p, data)
+	}
+
+	// Every exported field must have been set by the Caddyfile above, so
+	// that new options can't be added without round-trip coverage
+	v := reflect.ValueOf(decoded).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.IsExported() && v.Field(i).IsZero() {
+			t.Errorf("field %s is not covered by the round-trip test", f.Name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package parspackip
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the time source of an instance: its refresh loop, retries,
+// cache and carry-over ages. It is the time package unless replaced by
+// tests, which advance a fake clock instead of sleeping. Request durations
+// reported in logs and metrics are always measured on the real clock.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is a timer created by a clock
+type clockTimer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// realClock is the clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer { return realTimer{time.NewTimer(d)} }
+
+// realTimer adapts time.Timer to clockTimer
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clock returns the clock of p, the real one unless a test set another
+func (p *ParspackIPRange) clock() clock {
+	if p.clk == nil {
+		return realClock{}
+	}
+	return p.clk
+}
+
+// now returns the current time of the clock of p
+func (p *ParspackIPRange) now() time.Time {
+	return p.clock().Now()
+}
+
+// sleep waits for d on the clock of p. It returns false if ctx is done
+// first.
+func (p *ParspackIPRange) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := p.clock().NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// wallNow returns the current time without its monotonic clock reading.
+// The monotonic clock may stop while the machine is suspended, so the
+// schedule is kept on the wall clock instead.
+func (p *ParspackIPRange) wallNow() time.Time {
+	return p.now().Round(0)
+}
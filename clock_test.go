@@ -0,0 +1,331 @@
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// fakeClock is a clock that only moves when advanced. Every timer it
+// creates or resets is reported on armed, so that tests can wait for the
+// refresh loop to go back to sleep before advancing again.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	armed  chan struct{}
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, armed: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	t.Reset(d)
+	return t
+}
+
+// advance moves the clock forward by d and fires the timers that expired
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.active = false
+			t.c <- c.now
+		}
+	}
+}
+
+// waitArmed waits for the refresh loop to set a timer
+func (c *fakeClock) waitArmed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.armed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refresh loop didn't set a timer")
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	wasActive := t.active
+	t.deadline, t.active = t.clock.now.Add(d), true
+	t.clock.mu.Unlock()
+	t.clock.armed <- struct{}{}
+	return wasActive
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func TestRefreshLoopFakeClock(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	start := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		setup    func(p *ParspackIPRange)
+		earliest time.Duration
+		latest   time.Duration
+	}{
+		{
+			name:     "interval",
+			setup:    func(p *ParspackIPRange) { p.Interval = caddy.Duration(time.Hour) },
+			earliest: time.Hour,
+			latest:   time.Hour,
+		},
+		{
+			name: "jitter",
+			setup: func(p *ParspackIPRange) {
+				p.Interval = caddy.Duration(time.Hour)
+				p.Jitter = caddy.Duration(10 * time.Minute)
+			},
+			earliest: time.Hour,
+			latest:   time.Hour + 10*time.Minute,
+		},
+		{
+			name: "schedule",
+			setup: func(p *ParspackIPRange) {
+				s, err := parseSchedule("03:00")
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.schedule = s
+			},
+			earliest: 2 * time.Hour,
+			latest:   2 * time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches.Store(0)
+			clk := newFakeClock(start)
+			disabled := false
+			p := newTestSource()
+			p.URL = srv.URL
+			p.IPv6 = &disabled
+			p.MaxRetries = -1
+			p.clk = clk
+			tt.setup(p)
+			p.loopCtx, p.cancel = context.WithCancel(context.Background())
+			p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+			defer p.Cleanup()
+
+			clk.waitArmed(t)
+			if got := fetches.Load(); got != 1 {
+				t.Fatalf("got %d fetches after start, want the initial one", got)
+			}
+
+			// The loop wakes up at least every wakeCheckInterval, so every
+			// step fires its timer
+			var elapsed time.Duration
+			for fetches.Load() == 1 {
+				if elapsed > tt.latest {
+					t.Fatalf("no refresh after %v, want one by %v", elapsed, tt.latest)
+				}
+				clk.advance(wakeCheckInterval)
+				elapsed += wakeCheckInterval
+				clk.waitArmed(t)
+			}
+			if elapsed < tt.earliest || elapsed > tt.latest {
+				t.Errorf("refreshed after %v, want between %v and %v", elapsed, tt.earliest, tt.latest)
+			}
+		})
+	}
+}
+
+func TestRefreshLoopRetryAfter(t *testing.T) {
+	var fetches atomic.Int32
+	var retryAfter atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Retry-After", retryAfter.Load().(string))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		retryAfter string
+		want       time.Duration
+	}{
+		// Retry-After postpones the next refresh but never brings it
+		// forward, so a server asking for a short delay isn't polled more
+		{retryAfter: "5", want: time.Hour},
+		{retryAfter: "7200", want: 2 * time.Hour},
+		{retryAfter: "Fri, 01 Jan 2100 00:00:00 GMT", want: maxRetryAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.retryAfter, func(t *testing.T) {
+			fetches.Store(0)
+			retryAfter.Store(tt.retryAfter)
+			clk := newFakeClock(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC))
+			p := newTestSource()
+			p.URL = srv.URL
+			p.IPv6 = new(bool)
+			p.Interval = caddy.Duration(time.Hour)
+			p.clk = clk
+			p.loopCtx, p.cancel = context.WithCancel(context.Background())
+			p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+			defer p.Cleanup()
+
+			clk.waitArmed(t)
+			var elapsed time.Duration
+			for fetches.Load() == 1 {
+				if elapsed > tt.want {
+					t.Fatalf("no refresh after %v, want one after %v", elapsed, tt.want)
+				}
+				clk.advance(wakeCheckInterval)
+				elapsed += wakeCheckInterval
+				clk.waitArmed(t)
+			}
+			if elapsed != tt.want {
+				t.Errorf("refreshed after %v, want %v", elapsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchWithRetryFakeClock(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC))
+	p := newTestSource()
+	p.MaxRetries = 3
+	p.RetryBackoff = caddy.Duration(time.Second)
+	p.RetryJitter = retryJitterNone
+	p.clk = clk
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.fetchWithRetry(context.Background(), srv.URL, "")
+		done <- err
+	}()
+
+	// The back-off doubles on the fake clock, without sleeping
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		clk.waitArmed(t)
+		clk.advance(backoff - time.Millisecond)
+		select {
+		case <-done:
+			t.Fatalf("retried before the %v back-off elapsed", backoff)
+		case <-time.After(20 * time.Millisecond):
+		}
+		clk.advance(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("fetchWithRetry() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchWithRetry() didn't return")
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("got %d fetches, want 3", got)
+	}
+}
+
+func TestFetchWithRetryCanceledDuringBackoff(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC))
+	p := newTestSource()
+	p.MaxRetries = 3
+	p.RetryBackoff = caddy.Duration(time.Hour)
+	p.RetryJitter = retryJitterNone
+	p.clk = clk
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.fetchWithRetry(ctx, srv.URL, "")
+		done <- err
+	}()
+
+	// Stopping the config aborts the back-off without the clock moving
+	clk.waitArmed(t)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("fetchWithRetry() succeeded after cancellation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetchWithRetry() kept waiting out the back-off after cancellation")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+}
+
+func TestLoadCarriedFakeClock(t *testing.T) {
+	lastFetch := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	clk := newFakeClock(lastFetch.Add(59 * time.Minute))
+	p := newTestSource()
+	p.Interval = caddy.Duration(time.Hour)
+	p.clk = clk
+	p.carryKey = "fake-clock-test"
+	carried.Store(p.carryKey, &carriedState{fetched: prefixes("185.8.172.0/22"), lastFetch: lastFetch, expires: lastFetch.Add(time.Hour)})
+	defer carried.Delete(p.carryKey)
+
+	if !p.loadCarried() {
+		t.Fatal("ranges fetched less than an interval ago were not carried over")
+	}
+	clk.advance(time.Minute)
+	if newer := (&ParspackIPRange{Interval: p.Interval, clk: clk, carryKey: p.carryKey, logger: p.logger}); newer.loadCarried() {
+		t.Error("ranges fetched an interval ago were carried over")
+	}
+}
@@ -0,0 +1,188 @@
+package parspackip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "parspack-check",
+		Usage: "[--config <path>] [--url <url>] [--ipv6] [--timeout <duration>]",
+		Short: "Fetches the ParsPack IP list and reports what was parsed",
+		Long: `
+Fetches the ParsPack IP range list once, parses it the same way the
+http.ip_sources.parspack module does, and prints how many ranges were
+found. Lines that fail to parse are logged as warnings. Nothing is
+cached and no server is started, so this is safe to run against a
+custom --url before putting it in a config.
+
+With --config, every parspack source of the given Caddyfile (or JSON
+config, if the file ends in .json) is checked with its own options:
+authentication, headers, TLS settings, format, checksum and so on.
+Transformers, merged lists and hostnames to resolve are not applied.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().String("config", "", "Config file whose parspack sources to check")
+			cmd.Flags().String("url", ipv4URL, "URL to fetch the IPv4 list from")
+			cmd.Flags().Bool("ipv6", true, "Also fetch the ParsPack IPv6 list")
+			cmd.Flags().Duration("timeout", defaultTimeout, "Timeout for each request")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdParspackCheck)
+		},
+	})
+}
+
+func cmdParspackCheck(fs caddycmd.Flags) (int, error) {
+	logger := caddy.Log().Named("parspack-check")
+	if path := fs.String("config"); path != "" {
+		if fs.Changed("url") || fs.Changed("ipv6") {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--url and --ipv6 can't be combined with --config")
+		}
+		sources, err := loadCheckConfig(path)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(sources) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("no parspack source in %s", path)
+		}
+		code := caddy.ExitCodeSuccess
+		for _, p := range sources {
+			p.logger = logger
+			if fs.Changed("timeout") {
+				p.Timeout = caddy.Duration(fs.Duration("timeout"))
+			}
+			if err := checkSource(p); err != nil {
+				fmt.Fprintf(os.Stdout, "%s: %v\n", p.URL, err)
+				code = caddy.ExitCodeFailedStartup
+			}
+		}
+		return code, nil
+	}
+
+	ipv6 := fs.Bool("ipv6")
+	p := &ParspackIPRange{
+		URL:     fs.String("url"),
+		Timeout: caddy.Duration(fs.Duration("timeout")),
+		IPv6:    &ipv6,
+		logger:  logger,
+	}
+	if err := validateURL(p.URL); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid url: %v", err)
+	}
+	if err := checkSource(p); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// checkSource fetches the list of p once, without starting it, and prints
+// the number of ranges found
+func checkSource(p *ParspackIPRange) error {
+	if err := p.prepare(); err != nil {
+		return err
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	// Report every unparseable line, that's what the check is for
+	p.MaxParseWarnings = math.MaxInt
+
+	var err error
+	if p.client, err = p.newHTTPClient(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var ranges, v6 []netip.Prefix
+	source := p.URL
+	if p.File != "" {
+		source = p.File
+		ranges, v6, err = p.readFile()
+	} else {
+		ranges, v6, _, err = p.fetchRemote(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s: %d ranges (%d IPv4, %d IPv6)\n",
+		source, len(ranges), len(ranges)-len(v6), len(v6))
+	return nil
+}
+
+// loadCheckConfig returns the parspack sources configured in the Caddyfile
+// or JSON config at path
+func loadCheckConfig(path string) ([]*ParspackIPRange, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %v", err)
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		adapter := caddyconfig.GetAdapter("caddyfile")
+		if adapter == nil {
+			return nil, fmt.Errorf("caddyfile adapter not available")
+		}
+		if body, _, err = adapter.Adapt(body, map[string]any{"filename": path}); err != nil {
+			return nil, fmt.Errorf("adapting config: %v", err)
+		}
+	}
+
+	var cfg any
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding config: %v", err)
+	}
+	var found []map[string]any
+	findSources(cfg, &found)
+
+	sources := make([]*ParspackIPRange, 0, len(found))
+	for _, src := range found {
+		delete(src, "source")
+		raw, err := json.Marshal(src)
+		if err != nil {
+			return nil, fmt.Errorf("encoding parspack source: %v", err)
+		}
+		p := new(ParspackIPRange)
+		if err := json.Unmarshal(raw, p); err != nil {
+			return nil, fmt.Errorf("decoding parspack source: %v", err)
+		}
+		sources = append(sources, p)
+	}
+	return sources, nil
+}
+
+// findSources appends every parspack IP source found in v, a decoded
+// config, to found
+func findSources(v any, found *[]map[string]any) {
+	switch v := v.(type) {
+	case map[string]any:
+		if v["source"] == "parspack" {
+			*found = append(*found, v)
+			return
+		}
+		// Walk the keys in order, so sources are checked in the same
+		// order every run
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			findSources(v[key], found)
+		}
+	case []any:
+		for _, child := range v {
+			findSources(child, found)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package parspackip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestLoadCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Caddyfile")
+	config := `{
+	servers {
+		trusted_proxies parspack {
+			url https://example.com/ips.txt
+			header X-Token secret
+			format json
+		}
+	}
+}
+
+example.com {
+	respond "ok"
+}
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := loadCheckConfig(path)
+	if err != nil {
+		t.Fatalf("loadCheckConfig() error = %v", err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("got %d sources, want 1", len(sources))
+	}
+	p := sources[0]
+	if p.URL != "https://example.com/ips.txt" || p.Headers.Get("X-Token") != "secret" || p.Format != "json" {
+		t.Errorf("source = %+v, want the options of the directive", p)
+	}
+
+	if _, err := loadCheckConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for a missing config")
+	}
+}
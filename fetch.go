@@ -0,0 +1,679 @@
+package parspackip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// newHTTPClient creates the client shared by every fetch of this instance,
+// so connections and TLS sessions are reused across refreshes
+func (p *ParspackIPRange) newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if p.Proxy != "" {
+		proxyURL, err := url.Parse(p.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", p.Proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid proxy %q: scheme must be http, https, socks5 or socks5h", p.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// Unset values keep the defaults of http.DefaultTransport
+	if p.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(p.IdleConnTimeout)
+	}
+	if p.MaxIdleConns > 0 {
+		transport.MaxIdleConns = p.MaxIdleConns
+		transport.MaxIdleConnsPerHost = p.MaxIdleConns
+	}
+	if p.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(p.TLSHandshakeTimeout)
+	}
+
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	switch p.HTTPVersion {
+	case "1.1":
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case "2":
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+	}
+
+	// The client timeout covers the proxy connection as well
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(p.Timeout),
+	}, nil
+}
+
+// tlsConfig builds the TLS configuration for fetching from the TLS options,
+// or returns nil if none are set so the transport defaults apply
+func (p *ParspackIPRange) tlsConfig() (*tls.Config, error) {
+	if p.CAFile == "" && p.ClientCertFile == "" && !p.InsecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %q", p.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if p.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.ClientCertFile, p.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if p.InsecureSkipVerify {
+		p.log().Warn("TLS certificate verification is DISABLED for fetching IP ranges; " +
+			"the list can be forged by anyone on the network path, do not use this in production")
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// userAgent returns the User-Agent header value for outbound requests
+func (p *ParspackIPRange) userAgent() string {
+	if p.UserAgent != "" {
+		return p.UserAgent
+	}
+	simple, _ := caddy.Version()
+	return "caddy-parspack-ip (" + string(p.CaddyModule().ID) + ") Caddy/" + simple
+}
+
+// toPrimary reports whether req is sent to the host of URL. Only those
+// requests carry the configured credentials, headers and method: fallback
+// mirrors, merged lists and other hosts, such as parspack.com itself, get a
+// plain GET.
+func (p *ParspackIPRange) toPrimary(req *http.Request) bool {
+	u, err := url.Parse(p.URL)
+	return err == nil && u.Host == req.URL.Host
+}
+
+// setAuth adds the configured credentials to req if it is sent to the host
+// of URL
+func (p *ParspackIPRange) setAuth(req *http.Request) {
+	if p.BasicAuth == nil && p.BearerToken == "" || !p.toPrimary(req) {
+		return
+	}
+	if p.BasicAuth != nil {
+		req.SetBasicAuth(p.BasicAuth.Username, p.BasicAuth.Password)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+p.BearerToken)
+	}
+}
+
+// setHeaders adds the configured Headers to req if it is sent to the host
+// of URL, replacing any header of the same name already set
+func (p *ParspackIPRange) setHeaders(req *http.Request) {
+	if len(p.Headers) == 0 || !p.toPrimary(req) {
+		return
+	}
+	for name, values := range p.Headers {
+		req.Header.Del(name)
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
+
+// method returns the HTTP method used to request the lists from the host
+// of URL
+func (p *ParspackIPRange) method() string {
+	if p.Method != "" {
+		return p.Method
+	}
+	return http.MethodGet
+}
+
+// fetchWithFallback fetches the IPv4 list from URL, trying each fallback
+// mirror in order until one succeeds. It returns the URL the list was
+// served from along with the ranges.
+func (p *ParspackIPRange) fetchWithFallback(ctx context.Context) ([]netip.Prefix, string, error) {
+	ranges, err := p.fetchWithRetry(ctx, p.URL, p.ChecksumURL)
+	if err == nil || len(p.Fallbacks) == 0 {
+		return ranges, p.URL, err
+	}
+
+	errs := []error{err}
+	for _, fallback := range p.Fallbacks {
+		p.log().Warn("fetch failed, trying fallback",
+			zap.String("failed", p.URL),
+			zap.String("fallback", fallback),
+			zap.Error(err))
+
+		ranges, err = p.fetchWithRetry(ctx, fallback, p.ChecksumURL)
+		if err == nil {
+			p.log().Info("IP ranges served by fallback", zap.String("url", fallback))
+			return ranges, fallback, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// maxErrorSnippet is the number of bytes of the body of a non-200 response
+// quoted in the error
+const maxErrorSnippet = 256
+
+// statusError is returned when the endpoint answers with a non-200 status.
+// retryAfter is the delay requested by a 429 or 503 response's Retry-After
+// header, if any, and body the start of the response body, which often
+// tells why a WAF or an authentication gateway refused the request.
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *statusError) Error() string {
+	msg := fmt.Sprintf("%v: %d", ErrBadStatus, e.code)
+	if e.retryAfter > 0 {
+		msg += fmt.Sprintf(" (retry after %v)", e.retryAfter)
+	}
+	if e.body != "" {
+		msg += fmt.Sprintf(": %q", e.body)
+	}
+	return msg
+}
+
+// Unwrap makes a statusError match ErrBadStatus
+func (e *statusError) Unwrap() error {
+	return ErrBadStatus
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date, returning zero if it is absent or invalid. The delay is
+// capped at maxRetryAfter.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(min(max(seconds, 0), int(maxRetryAfter/time.Second))) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return min(max(date.Sub(now), 0), maxRetryAfter)
+	}
+	return 0
+}
+
+// freshnessLifetime returns how long a response stays fresh according to
+// its Cache-Control max-age or, failing that, its Expires and Date headers,
+// minus its Age. It reports false if the response carries neither.
+// no-cache and no-store make the response stale immediately.
+func freshnessLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	var lifetime time.Duration
+	found := false
+	for directive := range strings.SplitSeq(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return 0, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				lifetime, found = time.Duration(max(seconds, 0))*time.Second, true
+			}
+		}
+	}
+	if !found {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			// An invalid Expires, such as 0, means already expired
+			if header.Get("Expires") != "" {
+				return 0, true
+			}
+			return 0, false
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime, found = max(expires.Sub(date), 0), true
+	}
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		lifetime = max(lifetime-time.Duration(age)*time.Second, 0)
+	}
+	return lifetime, found
+}
+
+// recordLifetime keeps the freshness lifetime of a response to the IPv4
+// list, which AutoInterval schedules the next refresh from
+func (p *ParspackIPRange) recordLifetime(rawURL string, header http.Header) {
+	if !p.AutoInterval || (rawURL != p.URL && !slices.Contains(p.Fallbacks, rawURL)) {
+		return
+	}
+	lifetime, ok := freshnessLifetime(header, p.now())
+	if !ok {
+		p.lifetime.Store(0)
+		return
+	}
+	// Zero means unknown, an immediately stale response is clamped to
+	// MinInterval anyway
+	p.lifetime.Store(int64(max(lifetime, time.Nanosecond)))
+}
+
+// recordListVersion stores the version published in the header of the list
+// fetched from source, logging it when it changes. Lists without one clear
+// the previous version.
+func (p *ParspackIPRange) recordListVersion(source string, body []byte) {
+	version, _ := listVersion(string(body))
+	p.mu.Lock()
+	previous := p.listVersion
+	p.listVersion = version
+	p.mu.Unlock()
+	if version != "" && version != previous {
+		p.log().Info("fetched IP list version",
+			zap.String("source", source),
+			zap.String("version", version),
+			zap.String("previous", previous))
+	}
+}
+
+// retryAfterDelay returns the delay requested by the server through
+// Retry-After if err was caused by a rate-limited response, or zero
+func retryAfterDelay(err error) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.retryAfter
+	}
+	return 0
+}
+
+// Errors returned by a failed fetch, wrapped with more context. They can be
+// matched with errors.Is.
+var (
+	// ErrBadStatus is returned when the endpoint answers with a status
+	// other than 200 or 304
+	ErrBadStatus = errors.New("unexpected status code")
+
+	// ErrTooLarge is returned when a response body exceeds MaxBodySize
+	ErrTooLarge = errors.New("response body too large")
+
+	// ErrEmptyList is returned when a fetched list contains no ranges
+	ErrEmptyList = errors.New("empty IP list")
+
+	// ErrMalformedList is returned when none of the lines of a list could
+	// be parsed, e.g. when a mirror serves an error page
+	ErrMalformedList = errors.New("no valid IP ranges in list")
+
+	// ErrChecksumMismatch is returned when a list doesn't match its
+	// published checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrTooManyRanges is returned when a fetched list has more ranges
+	// than MaxRanges
+	ErrTooManyRanges = errors.New("too many IP ranges")
+
+	// ErrUnexpectedContentType is returned when a response is clearly not
+	// a list, such as the HTML page of a captive portal or WAF served with
+	// a 200 status
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+)
+
+// isTransient reports whether a failed fetch is worth retrying, which is
+// the case for network errors and 5xx responses without Retry-After
+func isTransient(err error) bool {
+	if errors.Is(err, ErrTooLarge) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrMalformedList) ||
+		errors.Is(err, ErrUnexpectedContentType) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		// The server asked to be left alone for a while, retrying right
+		// away would only make the rate limiting worse
+		if se.retryAfter > 0 {
+			return false
+		}
+		return se.code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// fetchWithRetry calls fetchFromURL, retrying transient failures with
+// exponential backoff randomized according to RetryJitter
+func (p *ParspackIPRange) fetchWithRetry(ctx context.Context, rawURL, checksumURL string) ([]netip.Prefix, error) {
+	backoff := time.Duration(p.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		ranges, err := p.fetchFromURL(ctx, rawURL, checksumURL)
+		if err == nil || attempt >= p.MaxRetries || !isTransient(err) {
+			return ranges, err
+		}
+
+		delay := p.retryDelay(backoff)
+		p.log().Debug("fetch failed, retrying",
+			zap.String("url", rawURL),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+
+		if !p.sleep(ctx, delay) {
+			return nil, err
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// retryDelay returns the time to wait before retrying after backoff
+func (p *ParspackIPRange) retryDelay(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	switch p.RetryJitter {
+	case retryJitterNone:
+		return backoff
+	case retryJitterEqual:
+		return backoff/2 + rand.N(backoff-backoff/2+1)
+	default:
+		return rand.N(backoff + 1)
+	}
+}
+
+// fetchFromURL fetches IP ranges from a URL. If checksumURL is not empty,
+// the body is verified against the SHA-256 published there.
+func (p *ParspackIPRange) fetchFromURL(ctx context.Context, rawURL, checksumURL string) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.toPrimary(req) {
+		req.Method = p.method()
+	}
+
+	req.Header.Set("User-Agent", p.userAgent())
+	req.Header.Set("Accept-Encoding", "gzip")
+	p.setHeaders(req)
+	p.setAuth(req)
+
+	// Make the request conditional if the list was fetched before. Other
+	// methods than GET answer a matching validator with 412, not 304.
+	p.mu.RLock()
+	prev, conditional := p.validators[rawURL]
+	p.mu.RUnlock()
+	conditional = conditional && req.Method == http.MethodGet
+	if conditional {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+
+	trace := p.newFetchTrace()
+	if trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+
+	start := time.Now()
+	defer func() { observeFetchDuration(time.Since(start).Seconds()) }()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if trace != nil {
+		resp.Body = trace.countBody(resp.Body)
+		defer trace.log(p.log(), rawURL, resp)
+	}
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified {
+		p.recordLifetime(rawURL, resp.Header)
+		if rawURL == p.URL || slices.Contains(p.Fallbacks, rawURL) {
+			p.mu.Lock()
+			p.proto = resp.Proto
+			p.mu.Unlock()
+		}
+	}
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		p.log().Debug("IP list not modified", zap.String("url", rawURL))
+		return prev.ranges, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		se := &statusError{code: resp.StatusCode, body: bodySnippet(resp)}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			se.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), p.now())
+		}
+		return nil, se
+	}
+
+	body, err := p.readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	format := p.formatOf(rawURL)
+	if err := checkContentType(format, resp.Header.Get("Content-Type"), body); err != nil {
+		return nil, err
+	}
+
+	if checksumURL != "" {
+		if err := p.verifyChecksum(ctx, body, checksumURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// The checksum is that of the file as published, compressed or not
+	if p.gzipped(rawURL) {
+		if body, err = p.gunzip(body); err != nil {
+			return nil, err
+		}
+	}
+
+	ranges, err := p.parseList(body, format, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if rawURL == p.URL || slices.Contains(p.Fallbacks, rawURL) {
+		if listFormat(format, resp.Header.Get("Content-Type")) == formatText {
+			p.recordListVersion(rawURL, body)
+		}
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	p.mu.Lock()
+	if etag != "" || lastModified != "" {
+		if p.validators == nil {
+			p.validators = make(map[string]validators)
+		}
+		p.validators[rawURL] = validators{etag: etag, lastModified: lastModified, ranges: ranges}
+	} else {
+		delete(p.validators, rawURL)
+	}
+	p.mu.Unlock()
+
+	return ranges, nil
+}
+
+// checkContentType rejects a response that is clearly not a list: an HTML
+// page, whatever the format, or a JSON document when a text list is
+// expected. Mislabelled text lists are still accepted with format text.
+func checkContentType(format, contentType string, body []byte) error {
+	if isHTMLMediaType(contentType) {
+		return fmt.Errorf("%w: %s", ErrUnexpectedContentType, contentType)
+	}
+	if listFormat(format, contentType) == formatText && isJSONMediaType(contentType) {
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return fmt.Errorf("%w: %s, but format is text", ErrUnexpectedContentType, contentType)
+		}
+	}
+	return nil
+}
+
+// verifyChecksum fetches the SHA-256 published at checksumURL and compares
+// it to the hash of body
+func (p *ParspackIPRange) verifyChecksum(ctx context.Context, body []byte, checksumURL string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", checksumURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", p.userAgent())
+	p.setHeaders(req)
+	p.setAuth(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching checksum: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching checksum: %w", &statusError{code: resp.StatusCode, body: bodySnippet(resp)})
+	}
+
+	// The checksum may be followed by a file name, as written by sha256sum
+	published, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("fetching checksum: %w", err)
+	}
+	fields := strings.Fields(string(published))
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: checksum file is empty", ErrChecksumMismatch)
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("%w: checksum file does not contain a SHA-256 hash", ErrChecksumMismatch)
+	}
+
+	got := sha256.Sum256(body)
+	if !bytes.Equal(got[:], want) {
+		return fmt.Errorf("%w: got %x, want %x", ErrChecksumMismatch, got, want)
+	}
+	return nil
+}
+
+// readBody reads the response body, decompressing it if the server sent it
+// gzipped. MaxBodySize applies to the decompressed size.
+func (p *ParspackIPRange) readBody(resp *http.Response) ([]byte, error) {
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing response: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, p.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.MaxBodySize {
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrTooLarge, p.MaxBodySize)
+	}
+	return body, nil
+}
+
+// gzipped reports whether the list at rawURL is a gzip-compressed file
+func (p *ParspackIPRange) gzipped(rawURL string) bool {
+	if p.Gzip && (rawURL == p.URL || slices.Contains(p.Fallbacks, rawURL)) {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(path.Ext(u.Path), ".gz")
+}
+
+// gunzip decompresses a list published gzip-compressed, bounding the
+// decompressed size by MaxBodySize as well
+func (p *ParspackIPRange) gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing list: %w", err)
+	}
+	defer gz.Close()
+	body, err := io.ReadAll(io.LimitReader(gz, p.MaxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing list: %w", err)
+	}
+	if int64(len(body)) > p.MaxBodySize {
+		return nil, fmt.Errorf("%w: limit is %d bytes decompressed", ErrTooLarge, p.MaxBodySize)
+	}
+	return body, nil
+}
+
+// bodySnippet returns the first maxErrorSnippet bytes of the body of resp
+// for an error message, with control characters and runs of whitespace
+// replaced by single spaces so that the log stays on one readable line
+func bodySnippet(resp *http.Response) string {
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return ""
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, _ := io.ReadAll(io.LimitReader(r, maxErrorSnippet+1))
+	truncated := len(data) > maxErrorSnippet
+	data = data[:min(len(data), maxErrorSnippet)]
+
+	snippet := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(string(data), ""))
+	snippet = strings.Join(strings.Fields(snippet), " ")
+	if truncated && snippet != "" {
+		snippet += "..."
+	}
+	return snippet
+}
@@ -0,0 +1,1307 @@
+package parspackip
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestSource returns an instance ready to fetch without being provisioned
+func newTestSource() *ParspackIPRange {
+	p := &ParspackIPRange{MaxBodySize: defaultMaxBodySize, logger: zap.NewNop()}
+	client, err := p.newHTTPClient()
+	if err != nil {
+		panic(err)
+	}
+	p.client = client
+	return p
+}
+
+func TestFetchFromURLConditional(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	for i := 0; i < 2; i++ {
+		ranges, err := p.fetchFromURL(context.Background(), srv.URL, "")
+		if err != nil {
+			t.Fatalf("fetch %d: error = %v", i, err)
+		}
+		if len(ranges) != 1 {
+			t.Fatalf("fetch %d: got %d ranges, want 1", i, len(ranges))
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("requests = %d, not modified = %d; want 2 and 1", requests, notModified)
+	}
+}
+
+func TestFetchFromURLUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if !strings.HasPrefix(got, "caddy-parspack-ip (http.ip_sources.parspack) Caddy/") {
+		t.Errorf("unexpected default User-Agent: %q", got)
+	}
+
+	p.UserAgent = "my-agent/1.0"
+	if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if got != "my-agent/1.0" {
+		t.Errorf("User-Agent = %q, want override", got)
+	}
+}
+
+func TestFetchFromURLMethodAndHeaders(t *testing.T) {
+	var gotMethod, gotKey, gotAccept, gotIfNoneMatch string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotKey = r.Header.Get("X-Api-Key")
+		gotAccept = r.Header.Get("Accept")
+		gotIfNoneMatch = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.Method = http.MethodPost
+	p.Headers = http.Header{"x-api-key": {"secret"}, "Accept": {"text/plain"}}
+	for range 2 {
+		if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+			t.Fatalf("fetchFromURL() error = %v", err)
+		}
+	}
+	if gotMethod != http.MethodPost || gotKey != "secret" || gotAccept != "text/plain" {
+		t.Errorf("method = %q, X-Api-Key = %q, Accept = %q", gotMethod, gotKey, gotAccept)
+	}
+	if gotIfNoneMatch != "" {
+		t.Errorf("If-None-Match = %q, conditional requests must only be made with GET", gotIfNoneMatch)
+	}
+}
+
+func TestFetchOtherHostsMethodAndHeaders(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	// The fallback and the merged list get a plain GET, without the
+	// gateway's headers
+	check := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.Header.Get("X-Api-Key") != "" {
+				t.Errorf("%s got %s with X-Api-Key %q, want a plain GET", name, r.Method, r.Header.Get("X-Api-Key"))
+			}
+			w.Write([]byte("185.8.172.0/22\n"))
+		})
+	}
+	fallback := httptest.NewServer(check("fallback"))
+	defer fallback.Close()
+	merged := httptest.NewServer(check("merged list"))
+	defer merged.Close()
+
+	p := newTestSource()
+	p.URL = primary.URL
+	p.Fallbacks = []string{fallback.URL}
+	p.Merge = []MergeSource{{URL: merged.URL, Format: formatText}}
+	p.IPv6 = new(bool)
+	p.MaxRetries = -1
+	p.Method = http.MethodPost
+	p.Headers = http.Header{"X-Api-Key": {"secret"}}
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+}
+
+func TestFetchFromURLAuth(t *testing.T) {
+	var got, gotFallback string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotFallback = r.Header.Get("Authorization")
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer fallback.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.Fallbacks = []string{fallback.URL}
+	p.MaxRetries = -1
+
+	p.BasicAuth = &BasicAuth{Username: "parspack", Password: "secret"}
+	if _, _, err := p.fetchWithFallback(context.Background()); err != nil {
+		t.Fatalf("fetchWithFallback() error = %v", err)
+	}
+	if want := "Basic cGFyc3BhY2s6c2VjcmV0"; got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+	if gotFallback != "" {
+		t.Errorf("credentials leaked to fallback on another host: %q", gotFallback)
+	}
+
+	p.BasicAuth = nil
+	p.BearerToken = "token"
+	if _, _, err := p.fetchWithFallback(context.Background()); err != nil {
+		t.Fatalf("fetchWithFallback() error = %v", err)
+	}
+	if want := "Bearer token"; got != want {
+		t.Errorf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestFetchFromURLProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer proxy.Close()
+
+	p := &ParspackIPRange{Proxy: proxy.URL, MaxBodySize: defaultMaxBodySize, logger: zap.NewNop()}
+	client, err := p.newHTTPClient()
+	if err != nil {
+		t.Fatalf("newHTTPClient() error = %v", err)
+	}
+	p.client = client
+
+	if _, err := p.fetchFromURL(context.Background(), "http://mirror.example.com/cdnips.txt", ""); err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if proxied != "http://mirror.example.com/cdnips.txt" {
+		t.Errorf("proxy received %q, want the mirror URL", proxied)
+	}
+}
+
+func TestNewHTTPClientTransportTuning(t *testing.T) {
+	p := &ParspackIPRange{
+		IdleConnTimeout:     caddy.Duration(30 * time.Second),
+		MaxIdleConns:        2,
+		TLSHandshakeTimeout: caddy.Duration(5 * time.Second),
+	}
+	client, err := p.newHTTPClient()
+	if err != nil {
+		t.Fatalf("newHTTPClient() error = %v", err)
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.IdleConnTimeout != 30*time.Second || transport.MaxIdleConns != 2 ||
+		transport.MaxIdleConnsPerHost != 2 || transport.TLSHandshakeTimeout != 5*time.Second {
+		t.Errorf("transport not tuned: idle timeout %v, max idle %d/%d, handshake timeout %v",
+			transport.IdleConnTimeout, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.TLSHandshakeTimeout)
+	}
+}
+
+func TestFetchFromURLHTTPVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		version string
+		want    string
+	}{
+		{version: "", want: "HTTP/2.0"},
+		{version: "1.1", want: "HTTP/1.1"},
+		{version: "2", want: "HTTP/2.0"},
+	} {
+		p := &ParspackIPRange{
+			MaxBodySize:        defaultMaxBodySize,
+			InsecureSkipVerify: true,
+			HTTPVersion:        tt.version,
+			URL:                srv.URL,
+			logger:             zap.NewNop(),
+		}
+		client, err := p.newHTTPClient()
+		if err != nil {
+			t.Fatalf("newHTTPClient() error = %v", err)
+		}
+		p.client = client
+		if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+			t.Fatalf("http_version %q: fetchFromURL() error = %v", tt.version, err)
+		}
+		if got := p.status().Protocol; got != tt.want {
+			t.Errorf("http_version %q: fetched over %s, want %s", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestNewHTTPClientInvalidProxy(t *testing.T) {
+	p := &ParspackIPRange{Proxy: "ftp://proxy.example.com"}
+	if _, err := p.newHTTPClient(); err == nil {
+		t.Error("expected error for unsupported proxy scheme")
+	}
+}
+
+func TestFetchFromURLCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	// Without the test server's CA the fetch fails verification
+	if _, err := newTestSource().fetchFromURL(context.Background(), srv.URL, ""); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ParspackIPRange{CAFile: caFile, MaxBodySize: defaultMaxBodySize, logger: zap.NewNop()}
+	client, err := p.newHTTPClient()
+	if err != nil {
+		t.Fatalf("newHTTPClient() error = %v", err)
+	}
+	p.client = client
+
+	ranges, err := p.fetchFromURL(context.Background(), srv.URL, "")
+	if err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if len(ranges) != 1 {
+		t.Errorf("got %d ranges, want 1", len(ranges))
+	}
+}
+
+func TestNewHTTPClientInvalidCAFile(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := &ParspackIPRange{CAFile: caFile}
+	if _, err := p.newHTTPClient(); err == nil {
+		t.Error("expected error for ca_file without certificates")
+	}
+}
+
+func TestFetchFromURLBodyTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("185.8.172.0/22\n", 100)))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.MaxBodySize = 64
+	if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("fetchFromURL() error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestFetchFromURLErrorSnippet(t *testing.T) {
+	body := "<html>\r\n<body>\tAccess denied\x1b[31m by WAF</body>\n</html>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	_, err := p.fetchFromURL(context.Background(), srv.URL, "")
+	if !errors.Is(err, ErrBadStatus) {
+		t.Fatalf("fetchFromURL() error = %v, want ErrBadStatus", err)
+	}
+	if want := `unexpected status code: 403: "<html> <body> Access denied [31m by WAF</body> </html>"`; err.Error() != want {
+		t.Errorf("fetchFromURL() error = %s, want %s", err, want)
+	}
+
+	body = strings.Repeat("denied ", 100)
+	_, err = p.fetchFromURL(context.Background(), srv.URL, "")
+	var se *statusError
+	if !errors.As(err, &se) || len(se.body) > maxErrorSnippet+len("...") || !strings.HasSuffix(se.body, "...") {
+		t.Errorf("fetchFromURL() error = %v, want a truncated snippet", err)
+	}
+}
+
+func TestFetchWithFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer mirror.Close()
+
+	p := newTestSource()
+	p.URL = primary.URL
+	p.Fallbacks = []string{mirror.URL}
+	ranges, source, err := p.fetchWithFallback(context.Background())
+	if err != nil {
+		t.Fatalf("fetchWithFallback() error = %v", err)
+	}
+	if len(ranges) != 1 {
+		t.Errorf("got %d ranges, want 1", len(ranges))
+	}
+	if source != mirror.URL {
+		t.Errorf("source = %q, want the mirror %q", source, mirror.URL)
+	}
+
+	p.Fallbacks = []string{primary.URL}
+	if _, _, err := p.fetchWithFallback(context.Background()); err == nil {
+		t.Error("expected error when every mirror fails")
+	}
+}
+
+func TestFetchWithRetryHonorsRetryAfter(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.MaxRetries = 3
+	_, err := p.fetchWithRetry(context.Background(), srv.URL, "")
+	if err == nil {
+		t.Fatal("expected error for rate-limited response")
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1 (no retries while rate limited)", requests)
+	}
+	if delay := retryAfterDelay(fmt.Errorf("wrapped: %w", err)); delay != 2*time.Minute {
+		t.Errorf("retryAfterDelay() = %v, want 2m", delay)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("connection reset"), want: true},
+		{err: &statusError{code: http.StatusBadGateway}, want: true},
+		{err: &statusError{code: http.StatusNotFound}, want: false},
+		{err: &statusError{code: http.StatusServiceUnavailable, retryAfter: time.Minute}, want: false},
+		{err: fmt.Errorf("wrapped: %w", ErrTooLarge), want: false},
+		{err: fmt.Errorf("wrapped: %w", ErrMalformedList), want: false},
+		// A captive portal page won't turn into the list on retry
+		{err: fmt.Errorf("%w: text/html", ErrUnexpectedContentType), want: false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-5", 0},
+		{"Mon, 01 Jan 2024 12:05:00 GMT", 5 * time.Minute},
+		{"Mon, 01 Jan 2024 11:00:00 GMT", 0},
+		// Bogus far-future values are capped
+		{"86400000", maxRetryAfter},
+		{"Fri, 01 Jan 2100 00:00:00 GMT", maxRetryAfter},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	const backoff = 8 * time.Second
+	tests := []struct {
+		jitter   string
+		min, max time.Duration
+	}{
+		{jitter: retryJitterNone, min: backoff, max: backoff},
+		{jitter: retryJitterEqual, min: backoff / 2, max: backoff},
+		{jitter: retryJitterFull, min: 0, max: backoff},
+		// Full jitter is used when unset, e.g. by parspack-check
+		{jitter: "", min: 0, max: backoff},
+	}
+
+	for _, tt := range tests {
+		p := &ParspackIPRange{RetryJitter: tt.jitter}
+		spread := map[time.Duration]bool{}
+		for range 100 {
+			delay := p.retryDelay(backoff)
+			if delay < tt.min || delay > tt.max {
+				t.Fatalf("retry_jitter=%q: retryDelay() = %v, want within [%v, %v]", tt.jitter, delay, tt.min, tt.max)
+			}
+			spread[delay] = true
+		}
+		if tt.min != tt.max && len(spread) < 2 {
+			t.Errorf("retry_jitter=%q: retryDelay() always returned %v", tt.jitter, p.retryDelay(backoff))
+		}
+	}
+	if got := (&ParspackIPRange{}).retryDelay(0); got != 0 {
+		t.Errorf("retryDelay(0) = %v, want 0", got)
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "none", header: http.Header{}},
+		{name: "max-age", header: http.Header{"Cache-Control": {"public, max-age=3600"}}, want: time.Hour, wantOK: true},
+		{name: "max-age minus age", header: http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"600"}}, want: 50 * time.Minute, wantOK: true},
+		{name: "no-cache", header: http.Header{"Cache-Control": {"no-cache"}}, wantOK: true},
+		{name: "expires", header: http.Header{
+			"Expires": {"Mon, 01 Jan 2024 14:00:00 GMT"},
+			"Date":    {"Mon, 01 Jan 2024 12:00:00 GMT"},
+		}, want: 2 * time.Hour, wantOK: true},
+		{name: "expires without date", header: http.Header{"Expires": {"Mon, 01 Jan 2024 12:30:00 GMT"}}, want: 30 * time.Minute, wantOK: true},
+		{name: "max-age over expires", header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {"Mon, 01 Jan 2024 14:00:00 GMT"},
+		}, want: time.Minute, wantOK: true},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}}, wantOK: true},
+	}
+	for _, tt := range tests {
+		got, ok := freshnessLifetime(tt.header, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: freshnessLifetime() = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAutoInterval(t *testing.T) {
+	var maxAge string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxAge != "" {
+			w.Header().Set("Cache-Control", "max-age="+maxAge)
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.AutoInterval = true
+	p.Interval = caddy.Duration(time.Hour)
+	p.MinInterval = caddy.Duration(5 * time.Minute)
+	p.MaxInterval = caddy.Duration(24 * time.Hour)
+
+	for _, tt := range []struct {
+		maxAge string
+		want   time.Duration
+	}{
+		{maxAge: "7200", want: 2 * time.Hour},
+		{maxAge: "10", want: 5 * time.Minute},
+		{maxAge: "604800", want: 24 * time.Hour},
+		{maxAge: "", want: time.Hour},
+	} {
+		maxAge = tt.maxAge
+		if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+			t.Fatalf("fetchFromURL() error = %v", err)
+		}
+		if got := p.period(); got != tt.want {
+			t.Errorf("max-age %q: period() = %v, want %v", tt.maxAge, got, tt.want)
+		}
+	}
+}
+
+func TestFetchIPRanges(t *testing.T) {
+	const initial = "185.8.172.0/22\n195.248.240.0/22\n"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration
+		strict  bool
+		wantErr bool
+		errIs   error
+		want    []netip.Prefix
+	}{
+		{
+			name: "valid list",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("185.8.172.0/22\n94.101.176.0/20\n"))
+			},
+			want: prefixes("94.101.176.0/20", "185.8.172.0/22", "2a0e:1c80::/32"),
+		},
+		{
+			name: "not modified",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotModified)
+			},
+			want: prefixes("185.8.172.0/22", "195.248.240.0/22", "2a0e:1c80::/32"),
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantErr: true,
+			errIs:   ErrBadStatus,
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+				}
+			},
+			timeout: 50 * time.Millisecond,
+			wantErr: true,
+		},
+		{
+			name:   "strict with invalid line",
+			strict: true,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("185.8.172.0/22\n94.101.176.0/20\n94.101.182.0/33\n"))
+			},
+			wantErr: true,
+			errIs:   ErrMalformedList,
+		},
+		{
+			name: "lenient with invalid line",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("185.8.172.0/22\n94.101.176.0/20\n94.101.182.0/33\n"))
+			},
+			want: prefixes("94.101.176.0/20", "185.8.172.0/22", "2a0e:1c80::/32"),
+		},
+		{
+			name: "malformed body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("<html>maintenance</html>\n"))
+			},
+			wantErr: true,
+			errIs:   ErrMalformedList,
+		},
+		{
+			name: "html page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>maintenance</html>\n"))
+			},
+			wantErr: true,
+			errIs:   ErrUnexpectedContentType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte(initial))
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r)
+			}))
+			defer srv.Close()
+			v6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("2a0e:1c80::/32\n"))
+			}))
+			defer v6.Close()
+
+			p := newTestSource()
+			p.URL = srv.URL
+			p.ipv6Endpoint = v6.URL
+			p.MaxRetries = -1
+			if err := p.fetchIPRanges(context.Background()); err != nil {
+				t.Fatalf("initial fetch error = %v", err)
+			}
+
+			handler = tt.handler
+			p.Strict = tt.strict
+			if tt.timeout > 0 {
+				p.client.Timeout = tt.timeout
+			}
+			err := p.fetchIPRanges(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchIPRanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+				t.Errorf("fetchIPRanges() error = %v, want %v", err, tt.errIs)
+			}
+
+			want := tt.want
+			if tt.wantErr {
+				// A failed refresh keeps serving the previous ranges
+				want = prefixes("185.8.172.0/22", "195.248.240.0/22", "2a0e:1c80::/32")
+				if p.status().LastError == "" {
+					t.Error("expected the failure to be recorded")
+				}
+			}
+			if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+				t.Errorf("GetIPRanges() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFetchIPRangesMaxStale(t *testing.T) {
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	for _, failClosed := range []bool{false, true} {
+		disabled := false
+		p := newTestSource()
+		p.URL = srv.URL
+		p.IPv6 = &disabled
+		p.MaxRetries = -1
+		p.MaxStale = caddy.Duration(time.Hour)
+		p.FailClosed = failClosed
+		p.additional = prefixes("10.0.0.0/8")
+
+		failing = false
+		if err := p.fetchIPRanges(context.Background()); err != nil {
+			t.Fatalf("initial fetch error = %v", err)
+		}
+
+		failing = true
+		p.fetchIPRanges(context.Background())
+		if st := p.status(); st.Stale || st.ConsecutiveFailures != 1 || st.Count != 2 {
+			t.Errorf("fail_closed=%v: unexpected status before max_stale: %+v", failClosed, st)
+		}
+
+		p.mu.Lock()
+		p.lastFetch = time.Now().Add(-2 * time.Hour)
+		p.mu.Unlock()
+		p.fetchIPRanges(context.Background())
+
+		wantCount := 2
+		if failClosed {
+			// Only the additional range is left
+			wantCount = 1
+		}
+		if st := p.status(); !st.Stale || st.ConsecutiveFailures != 2 || st.Count != wantCount {
+			t.Errorf("fail_closed=%v: unexpected status after max_stale: %+v", failClosed, st)
+		}
+
+		failing = false
+		if err := p.fetchIPRanges(context.Background()); err != nil {
+			t.Fatalf("recovery fetch error = %v", err)
+		}
+		if st := p.status(); st.Stale || st.ConsecutiveFailures != 0 || st.Count != 2 {
+			t.Errorf("fail_closed=%v: unexpected status after recovery: %+v", failClosed, st)
+		}
+	}
+}
+
+func TestFetchIPRangesOnError(t *testing.T) {
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		onError    string
+		firstFetch bool
+		wantCount  int
+	}{
+		// The bootstrap range keeps being served until a fetch succeeds
+		{onError: onErrorKeep, firstFetch: true, wantCount: 2},
+		{onError: onErrorClear, firstFetch: true, wantCount: 1},
+		// The last good set keeps being served
+		{onError: onErrorKeep, firstFetch: false, wantCount: 2},
+		{onError: onErrorClear, firstFetch: false, wantCount: 1},
+	}
+
+	for _, tt := range tests {
+		disabled := false
+		p := newTestSource()
+		p.URL = srv.URL
+		p.IPv6 = &disabled
+		p.MaxRetries = -1
+		p.OnError = tt.onError
+		p.additional = prefixes("10.0.0.0/8")
+
+		if tt.firstFetch {
+			p.mu.Lock()
+			p.fetched = prefixes("195.248.240.0/22")
+			p.rebuildLocked()
+			p.mu.Unlock()
+		} else {
+			failing = false
+			if err := p.fetchIPRanges(context.Background()); err != nil {
+				t.Fatalf("initial fetch error = %v", err)
+			}
+		}
+
+		failing = true
+		if err := p.fetchIPRanges(context.Background()); err == nil {
+			t.Fatalf("on_error=%s first=%v: expected the fetch to fail", tt.onError, tt.firstFetch)
+		}
+		if got := len(p.GetIPRanges(nil)); got != tt.wantCount {
+			t.Errorf("on_error=%s first=%v: got %d ranges, want %d", tt.onError, tt.firstFetch, got, tt.wantCount)
+		}
+
+		failing = false
+		if err := p.fetchIPRanges(context.Background()); err != nil {
+			t.Fatalf("recovery fetch error = %v", err)
+		}
+		if got := len(p.GetIPRanges(nil)); got != 2 {
+			t.Errorf("on_error=%s first=%v: got %d ranges after recovery, want 2", tt.onError, tt.firstFetch, got)
+		}
+	}
+}
+
+func TestFetchIPRangesConfirmChanges(t *testing.T) {
+	body := "185.8.172.0/22\n195.248.240.0/22\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+	p.ConfirmChanges = 3
+
+	steps := []struct {
+		body        string
+		want        []netip.Prefix
+		wantPending int
+	}{
+		{body: body, want: prefixes("185.8.172.0/22", "195.248.240.0/22")},
+		// Additions apply at once, removals are staged
+		{body: "185.8.172.0/22\n94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22", "195.248.240.0/22"), wantPending: 1},
+		{body: "185.8.172.0/22\n94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22", "195.248.240.0/22"), wantPending: 1},
+		{body: "185.8.172.0/22\n94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22")},
+		// A range coming back starts over
+		{body: "94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22"), wantPending: 1},
+		{body: "185.8.172.0/22\n94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22")},
+		{body: "94.101.176.0/20\n", want: prefixes("94.101.176.0/20", "185.8.172.0/22"), wantPending: 1},
+	}
+	for i, step := range steps {
+		body = step.body
+		if err := p.fetchIPRanges(context.Background()); err != nil {
+			t.Fatalf("fetch %d error = %v", i, err)
+		}
+		if got := p.GetIPRanges(nil); !slices.Equal(got, step.want) {
+			t.Errorf("fetch %d: GetIPRanges() = %v, want %v", i, got, step.want)
+		}
+		if got := p.status().PendingRemovals; got != step.wantPending {
+			t.Errorf("fetch %d: %d pending removals, want %d", i, got, step.wantPending)
+		}
+	}
+	if got := p.status().Sources["185.8.172.0/22"]; got != srv.URL {
+		t.Errorf("source of the staged range = %q, want %q", got, srv.URL)
+	}
+}
+
+func TestFetchIPRangesKeepsPreviousOnEmptyList(t *testing.T) {
+	body := "185.8.172.0/22\n195.248.240.0/22\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+	p.MinRatio = 0.75
+
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("initial fetch error = %v", err)
+	}
+
+	body = ""
+	if err := p.fetchIPRanges(context.Background()); !errors.Is(err, ErrEmptyList) {
+		t.Errorf("fetch of empty list error = %v, want ErrEmptyList", err)
+	}
+	if got := len(p.GetIPRanges(nil)); got != 2 {
+		t.Errorf("got %d ranges after empty fetch, want previous 2", got)
+	}
+
+	body = "185.8.172.0/22\n"
+	if err := p.fetchIPRanges(context.Background()); err == nil {
+		t.Error("expected error when list shrinks below min_ratio")
+	}
+	if got := len(p.GetIPRanges(nil)); got != 2 {
+		t.Errorf("got %d ranges after shrunk fetch, want previous 2", got)
+	}
+
+	p.MaxRanges = 2
+	body = "185.8.172.0/22\n195.248.240.0/22\n94.101.176.0/20\n"
+	if err := p.fetchIPRanges(context.Background()); !errors.Is(err, ErrTooManyRanges) {
+		t.Errorf("fetch above max_ranges error = %v, want ErrTooManyRanges", err)
+	}
+	if got := len(p.GetIPRanges(nil)); got != 2 {
+		t.Errorf("got %d ranges after oversized fetch, want previous 2", got)
+	}
+}
+
+func TestFetchFromURLGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("185.8.172.0/22\n"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("185.8.172.0/22\n195.248.240.0/22\n"))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	ranges, err := newTestSource().fetchFromURL(context.Background(), srv.URL, "")
+	if err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if len(ranges) != 2 {
+		t.Errorf("got %d ranges, want 2 from the gzipped body", len(ranges))
+	}
+}
+
+func TestFetchFromURLTrace(t *testing.T) {
+	body := "185.8.172.0/22\n195.248.240.0/22\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	p := newTestSource()
+	p.logger = zap.New(core)
+	for range 2 {
+		if _, err := p.fetchFromURL(context.Background(), srv.URL, ""); err != nil {
+			t.Fatalf("fetchFromURL() error = %v", err)
+		}
+	}
+
+	entries := logs.FilterMessage("fetched IP list").All()
+	if len(entries) != 2 {
+		t.Fatalf("got %d trace entries, want 2", len(entries))
+	}
+	first, second := entries[0].ContextMap(), entries[1].ContextMap()
+	if first["bytes"] != int64(len(body)) || first["status"] != int64(http.StatusOK) {
+		t.Errorf("first fetch logged %v bytes with status %v, want %d with 200", first["bytes"], first["status"], len(body))
+	}
+	for _, field := range []string{"connect", "first_byte", "total"} {
+		if _, ok := first[field]; !ok {
+			t.Errorf("first fetch didn't log %s: %v", field, first)
+		}
+	}
+	// The second fetch reuses the connection
+	if _, ok := second["connect"]; ok || second["reused_connection"] != true {
+		t.Errorf("second fetch logged %v, want a reused connection", second)
+	}
+
+	// Without Debug logging, nothing is traced
+	core, _ = observer.New(zapcore.InfoLevel)
+	p.logger = zap.New(core)
+	if p.newFetchTrace() != nil {
+		t.Error("newFetchTrace() traced a request with Debug logging disabled")
+	}
+}
+
+func TestFetchFromURLGzipFile(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "cdnips.txt.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A static file, not a compressed encoding of the list
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	want := prefixes("185.8.172.0/22", "195.248.240.0/22", "94.101.176.0/20")
+	for _, tt := range []struct {
+		name   string
+		url    string
+		option bool
+	}{
+		{name: "gz suffix", url: srv.URL + "/cdnips.txt.gz"},
+		{name: "gzip option", url: srv.URL + "/cdnips", option: true},
+	} {
+		p := newTestSource()
+		p.URL = tt.url
+		p.Gzip = tt.option
+		ranges, err := p.fetchFromURL(context.Background(), tt.url, "")
+		if err != nil {
+			t.Fatalf("%s: fetchFromURL() error = %v", tt.name, err)
+		}
+		if !slices.Equal(ranges, want) {
+			t.Errorf("%s: fetchFromURL() = %v, want %v", tt.name, ranges, want)
+		}
+	}
+
+	p := newTestSource()
+	p.MaxBodySize = 32
+	if _, err := p.gunzip(fixture); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("gunzip() above max_body_size error = %v, want ErrTooLarge", err)
+	}
+	if _, err := newTestSource().fetchFromURL(context.Background(), srv.URL+"/cdnips", ""); err == nil {
+		t.Error("expected an error parsing the compressed list without gzip")
+	}
+}
+
+func TestFetchFromURLFormat(t *testing.T) {
+	const jsonBody = `{"ipv4": ["185.8.172.0/22", "bogus"], "ipv6": ["2a0e:1c80::/29"]}`
+	const textBody = "185.8.172.0/22\n"
+
+	tests := []struct {
+		name        string
+		format      string
+		contentType string
+		body        string
+		want        int
+		wantErr     error
+	}{
+		{name: "auto text", contentType: "text/plain", body: textBody, want: 1},
+		{name: "auto json", contentType: "application/json; charset=utf-8", body: jsonBody, want: 2},
+		{name: "auto json suffix", contentType: "application/vnd.parspack+json", body: jsonBody, want: 2},
+		{name: "auto without content type", body: textBody, want: 1},
+		{name: "forced json", format: formatJSON, contentType: "text/plain", body: jsonBody, want: 2},
+		{name: "forced text", format: formatText, contentType: "application/json", body: textBody, want: 1},
+		{name: "invalid json", format: formatJSON, body: `{"ipv4": [`, wantErr: ErrMalformedList},
+		{name: "html page", contentType: "text/html; charset=utf-8", body: "<html>captive portal</html>", wantErr: ErrUnexpectedContentType},
+		{name: "html with forced text", format: formatText, contentType: "text/html", body: textBody, wantErr: ErrUnexpectedContentType},
+		{name: "json with forced text", format: formatText, contentType: "application/json", body: jsonBody, wantErr: ErrUnexpectedContentType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			p := newTestSource()
+			p.Format = tt.format
+			ranges, err := p.fetchFromURL(context.Background(), srv.URL, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("fetchFromURL() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(ranges) != tt.want {
+				t.Errorf("got %d ranges, want %d", len(ranges), tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchFromURLChecksum(t *testing.T) {
+	list := []byte("185.8.172.0/22\n")
+	sum := sha256.Sum256(list)
+	checksum := hex.EncodeToString(sum[:]) + "  cdnips.txt\n"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cdnips.txt", func(w http.ResponseWriter, r *http.Request) { w.Write(list) })
+	mux.HandleFunc("/cdnips.txt.sha256", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(checksum)) })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := newTestSource()
+	ranges, err := p.fetchFromURL(context.Background(), srv.URL+"/cdnips.txt", srv.URL+"/cdnips.txt.sha256")
+	if err != nil {
+		t.Fatalf("fetchFromURL() error = %v", err)
+	}
+	if len(ranges) != 1 {
+		t.Errorf("got %d ranges, want 1", len(ranges))
+	}
+
+	list = []byte("0.0.0.0/0\n")
+	if _, err := p.fetchFromURL(context.Background(), srv.URL+"/cdnips.txt", srv.URL+"/cdnips.txt.sha256"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("fetchFromURL() of tampered list error = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestFetchIPRangesFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cdnips.txt")
+	if err := os.WriteFile(file, []byte("185.8.172.0/22\n2a0e:1c80::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestSource()
+	p.File = file
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	if got := len(p.GetIPRanges(nil)); got != 2 {
+		t.Errorf("got %d ranges, want 2", got)
+	}
+
+	// Edits are picked up on the next refresh
+	if err := os.WriteFile(file, []byte("185.8.172.0/22\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	if got := len(p.GetIPRanges(nil)); got != 1 {
+		t.Errorf("got %d ranges after edit, want 1", got)
+	}
+}
+
+func TestRefreshLoopInitialRetry(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first two attempts, as during a maintenance window
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+	p.MaxRetries = -1
+	p.Interval = caddy.Duration(time.Hour)
+	p.InitialDelay = caddy.Duration(10 * time.Millisecond)
+	p.InitialRetry = caddy.Duration(10 * time.Millisecond)
+	p.loopCtx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+	defer p.Cleanup()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.hasFetched() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no successful fetch after %d requests", requests.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestRefreshLoopFailureLogLevel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		level string
+		want  zapcore.Level
+	}{
+		{level: "", want: zapcore.ErrorLevel},
+		{level: "warn", want: zapcore.WarnLevel},
+		{level: "debug", want: zapcore.DebugLevel},
+	} {
+		core, logs := observer.New(zapcore.DebugLevel)
+		disabled := false
+		p := newTestSource()
+		p.logger = zap.New(core)
+		p.URL = srv.URL
+		p.IPv6 = &disabled
+		p.MaxRetries = -1
+		p.Interval = caddy.Duration(time.Hour)
+		p.InitialRetry = caddy.Duration(10 * time.Millisecond)
+		p.FailureLogLevel = tt.level
+		p.loopCtx, p.cancel = context.WithCancel(context.Background())
+		p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+
+		deadline := time.Now().Add(5 * time.Second)
+		for logs.FilterMessage("failed to refresh IP ranges").Len() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("failure_log_level=%q: no refresh failure logged", tt.level)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		p.Cleanup()
+
+		for _, msg := range []string{"failed to fetch initial IP ranges", "failed to refresh IP ranges"} {
+			if got := logs.FilterMessage(msg).All()[0].Level; got != tt.want {
+				t.Errorf("failure_log_level=%q: %q logged at %v, want %v", tt.level, msg, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestStaticOnly(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.StaticOnly = true
+	p.Additional = []string{"10.0.0.0/8"}
+	p.Interval = caddy.Duration(time.Hour)
+	if err := p.start(); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer p.stop()
+
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got, want := p.GetIPRanges(nil), prefixes("10.0.0.0/8"); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if !p.Ready() {
+		t.Error("Ready() = false, want true for a static-only instance")
+	}
+	if got := requests.Load(); got != 0 {
+		t.Errorf("got %d requests, want none", got)
+	}
+}
+
+func TestRefreshCoalescesConcurrentCalls(t *testing.T) {
+	var requests atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+
+	errs := make(chan error, 3)
+	go func() { errs <- p.refresh(context.Background()) }()
+	<-started
+	for range 2 {
+		go func() { errs <- p.refresh(context.Background()) }()
+	}
+	// Let the later calls join the in-flight fetch
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Errorf("refresh() error = %v", err)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want overlapping refreshes to share 1", got)
+	}
+}
+
+func TestCleanupWaitsForInFlightFetch(t *testing.T) {
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	p := newTestSource()
+	p.URL = srv.URL
+	p.Interval = caddy.Duration(time.Hour)
+	p.loopCtx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Go(func() { p.refreshLoop(p.loopCtx) })
+
+	<-started
+	done := make(chan struct{})
+	go func() {
+		p.Cleanup()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cleanup() did not return while a fetch was in flight")
+	}
+	if got := len(p.GetIPRanges(nil)); got != 0 {
+		t.Errorf("got %d ranges after cancelled fetch, want 0", got)
+	}
+}
+
+func TestLogRangeChanges(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	p := &ParspackIPRange{logger: zap.New(core)}
+
+	p.logRangeChanges(prefixes("185.8.172.0/22"), prefixes("195.248.240.0/22"))
+	entries := logs.TakeAll()
+	if len(entries) != 1 || entries[0].Level != zap.InfoLevel {
+		t.Fatalf("got %v, want a single Info entry", entries)
+	}
+	if got := entries[0].ContextMap()["added"]; !reflect.DeepEqual(got, []any{"185.8.172.0/22"}) {
+		t.Errorf("added = %v, want [185.8.172.0/22]", got)
+	}
+
+	large := make([]netip.Prefix, maxLoggedChanges+1)
+	for i := range large {
+		large[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i), 0}), 24)
+	}
+	p.logRangeChanges(large, nil)
+	entries = logs.TakeAll()
+	if len(entries) != 2 || entries[0].Level != zap.InfoLevel || entries[1].Level != zap.DebugLevel {
+		t.Fatalf("got %v, want an Info summary and a Debug entry", entries)
+	}
+	if _, ok := entries[0].ContextMap()["added"]; ok {
+		t.Error("Info summary of a large diff should not list prefixes")
+	}
+}
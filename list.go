@@ -0,0 +1,114 @@
+package parspackip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(List{})
+	httpcaddyfile.RegisterHandlerDirective("parspack_list", parseListHandler)
+	httpcaddyfile.RegisterDirectiveOrder("parspack_list", httpcaddyfile.Before, "respond")
+}
+
+// List is an HTTP handler that serves the ranges of a ParsPack IP source,
+// one CIDR per line, so that nearby Caddy instances can point their url at
+// it instead of each fetching from parspack.com. The version published by
+// the list, if any, is kept as a "# updated" header comment, and
+// conditional requests are answered from an ETag of the list and the time
+// the ranges last changed.
+//
+// The ranges are served as trusted by the source, that is after additional,
+// exclude and the other options have been applied. Until the source has
+// ranges to serve, requests fail with 503 Service Unavailable so that the
+// mirrors keep their previous ones.
+type List struct {
+	// URL selects the source to serve by its url option.
+	// By default, the most recently provisioned source is served.
+	URL string `json:"url,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information
+func (List) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.parspack_list",
+		New: func() caddy.Module { return new(List) },
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler. It doesn't call next.
+func (l List) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	p := l.instance()
+	if p == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no ParsPack IP source loaded"))
+	}
+	src := p.source()
+	src.mu.RLock()
+	ranges, version, modified := src.ipRanges, src.listVersion, src.modified
+	src.mu.RUnlock()
+	if len(ranges) == 0 {
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no IP ranges loaded yet"))
+	}
+
+	var buf bytes.Buffer
+	if version != "" {
+		fmt.Fprintf(&buf, "# updated %s\n", version)
+	}
+	for _, prefix := range ranges {
+		buf.WriteString(prefix.String())
+		buf.WriteByte('\n')
+	}
+
+	// The ranges also change without a fetch, e.g. when merged lists,
+	// override files or hostnames are refreshed, so conditional requests
+	// are answered from the content and the time it last changed
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(buf.Bytes()))
+	return nil
+}
+
+// instance returns the most recently provisioned source matching URL
+func (l List) instance() *ParspackIPRange {
+	return findInstance(l.URL)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	parspack_list [<url>]
+func (l *List) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip directive name
+	if d.NextArg() {
+		l.URL = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseListHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var l List
+	err := l.UnmarshalCaddyfile(h.Dispenser)
+	return l, err
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*List)(nil)
+	_ caddyfile.Unmarshaler       = (*List)(nil)
+)
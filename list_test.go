@@ -0,0 +1,132 @@
+package parspackip
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestListRoundTrip(t *testing.T) {
+	lastFetch := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	want := prefixes("185.8.172.0/22", "195.248.240.0/22", "2a0e:1c80::/32")
+	p := &ParspackIPRange{
+		URL:         ipv4URL,
+		ipRanges:    want,
+		lastFetch:   lastFetch,
+		modified:    lastFetch,
+		listVersion: "2024-01-01",
+	}
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := (List{}).ServeHTTP(w, r, nil); err != nil {
+			var he caddyhttp.HandlerError
+			errors.As(err, &he)
+			w.WriteHeader(he.StatusCode)
+		}
+	}))
+	defer srv.Close()
+
+	mirror := newTestSource()
+	disabled := false
+	mirror.URL = srv.URL
+	mirror.IPv6 = &disabled
+	if err := mirror.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	if got := mirror.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("mirrored ranges = %v, want %v", got, want)
+	}
+	if got := mirror.status().ListVersion; got != "2024-01-01" {
+		t.Errorf("mirrored version = %q, want 2024-01-01", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("If-Modified-Since", lastFetch.Format(http.TimeFormat))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request status = %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestListChangedWithoutFetch(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	p := newTestSource()
+	p.URL = ipv4URL
+	p.clk = clk
+	p.fetched = prefixes("185.8.172.0/22")
+	p.rebuildLocked()
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		if err := (List{}).ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("ServeHTTP() error = %v", err)
+		}
+		return w
+	}
+	first := get("", "")
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("got ETag %q and Last-Modified %q, want both", etag, lastModified)
+	}
+	if code := get("If-None-Match", etag).Code; code != http.StatusNotModified {
+		t.Errorf("unchanged list status = %d, want 304", code)
+	}
+
+	// An override, merged list or hostname changes the ranges while the
+	// last fetch stays the same
+	clk.advance(time.Minute)
+	p.mu.Lock()
+	p.additional = prefixes("203.0.113.0/24")
+	p.rebuildLocked()
+	p.mu.Unlock()
+	for _, cond := range [][2]string{{"If-None-Match", etag}, {"If-Modified-Since", lastModified}} {
+		if code := get(cond[0], cond[1]).Code; code != http.StatusOK {
+			t.Errorf("changed list with %s status = %d, want 200", cond[0], code)
+		}
+	}
+}
+
+func TestListUnavailable(t *testing.T) {
+	p := &ParspackIPRange{URL: ipv4URL}
+	registerInstance(p)
+	defer unregisterInstance(p)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, l := range []List{{}, {URL: "https://mirror.example.com/cdnips.txt"}} {
+		err := l.ServeHTTP(httptest.NewRecorder(), r, nil)
+		var he caddyhttp.HandlerError
+		if !errors.As(err, &he) || he.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("ServeHTTP(%q) error = %v, want 503", l.URL, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.ipRanges = []netip.Prefix{netip.MustParsePrefix("185.8.172.0/22")}
+	p.mu.Unlock()
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	err := (List{}).ServeHTTP(httptest.NewRecorder(), r, nil)
+	var he caddyhttp.HandlerError
+	if !errors.As(err, &he) || he.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("ServeHTTP() of a POST error = %v, want 405", err)
+	}
+}
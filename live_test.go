@@ -0,0 +1,53 @@
+//go:build integration
+
+package parspackip
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestLiveIPv4List fetches the official list and checks that it still
+// parses, to catch format changes on ParsPack's side. It needs network
+// access and only runs with -tags integration.
+func TestLiveIPv4List(t *testing.T) {
+	p := newTestSource()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ipv4URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", p.userAgent())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		t.Fatalf("fetching %s: %v", ipv4URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fetching %s: status %d", ipv4URL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, defaultMaxBodySize))
+	if err != nil {
+		t.Fatalf("reading %s: %v", ipv4URL, err)
+	}
+
+	// Any skipped line means the format drifted
+	p.Strict = true
+	ranges, err := p.parseIPRanges(string(body))
+	if err != nil {
+		t.Fatalf("parseIPRanges() error = %v\n%s", err, body)
+	}
+	if len(ranges) == 0 {
+		t.Fatal("the official list parsed into no ranges")
+	}
+	for _, prefix := range ranges {
+		if !prefix.IsValid() || !prefix.Addr().Is4() {
+			t.Errorf("%s is not a valid IPv4 prefix", prefix)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package parspackip
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// AsMatcher returns a request matcher matching the requests coming from an
+// address within the current ranges, for routing on them directly rather
+// than through trusted_proxies. The address matched is the peer the
+// request was received from, which is the CDN edge for proxied requests,
+// not the client address derived from forwarding headers. p must have been
+// provisioned.
+func (p *ParspackIPRange) AsMatcher() caddyhttp.RequestMatcher {
+	return rangeMatcher{p}
+}
+
+// rangeMatcher matches requests whose peer address is in the ranges of p
+type rangeMatcher struct {
+	p *ParspackIPRange
+}
+
+// Match implements caddyhttp.RequestMatcher
+func (m rangeMatcher) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError implements caddyhttp.RequestMatcherWithError. Requests
+// without an IP peer address, like those received over a Unix socket,
+// don't match.
+func (m rangeMatcher) MatchWithError(r *http.Request) (bool, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false, nil
+	}
+	return m.p.Contains(addrPort.Addr()), nil
+}
+
+// Interface guards
+var (
+	_ caddyhttp.RequestMatcher          = rangeMatcher{}
+	_ caddyhttp.RequestMatcherWithError = rangeMatcher{}
+)
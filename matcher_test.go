@@ -0,0 +1,36 @@
+package parspackip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAsMatcher(t *testing.T) {
+	p := &ParspackIPRange{fetched: prefixes("185.8.172.0/22", "2a0e:1c80::/32")}
+	p.rebuildLocked()
+	m := p.AsMatcher()
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       bool
+	}{
+		{remoteAddr: "185.8.172.10:443", want: true},
+		{remoteAddr: "[2a0e:1c80::1]:443", want: true},
+		{remoteAddr: "[::ffff:185.8.172.10]:443", want: true},
+		// Forwarding headers don't count, only the peer does
+		{remoteAddr: "1.1.1.1:443", forwarded: "185.8.172.10", want: false},
+		{remoteAddr: "@", want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := m.Match(r); got != tt.want {
+			t.Errorf("Match() from %s = %v, want %v", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
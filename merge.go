@@ -0,0 +1,64 @@
+package parspackip
+
+import (
+	"context"
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// MergeSource is a list from another provider, such as another CDN in front
+// of the same origin, fetched on every refresh and merged into the ranges
+type MergeSource struct {
+	// URL is the http or https URL of the list
+	URL string `json:"url"`
+
+	// Format is the format of the list, as for the ParsPack one
+	// (default auto)
+	Format string `json:"format,omitempty"`
+}
+
+// refreshMerged fetches every Merge source and stores their ranges apart
+// from the ParsPack ones, like additional ranges, so that a failing
+// ParsPack fetch neither stops them refreshing nor clears them. A source
+// that fails or returns an empty list keeps its previous ranges, so it
+// never blanks the others.
+func (p *ParspackIPRange) refreshMerged(ctx context.Context) {
+	if len(p.Merge) == 0 {
+		return
+	}
+	p.mu.RLock()
+	prev := p.merged
+	p.mu.RUnlock()
+
+	merged := make(map[string][]netip.Prefix, len(p.Merge))
+	for _, m := range p.Merge {
+		fetched, err := p.fetchWithRetry(ctx, m.URL, "")
+		switch {
+		case err != nil:
+			p.log().Warn("failed to fetch merged list, keeping its previous ranges",
+				zap.String("url", m.URL),
+				zap.Error(err))
+			fetched = prev[m.URL]
+		case len(fetched) == 0:
+			p.log().Warn("merged list is empty, keeping its previous ranges", zap.String("url", m.URL))
+			fetched = prev[m.URL]
+		}
+		merged[m.URL] = fetched
+	}
+
+	p.mu.Lock()
+	p.merged = merged
+	p.rebuildLocked()
+	p.mu.Unlock()
+}
+
+// formatOf returns the configured format of the list at rawURL
+func (p *ParspackIPRange) formatOf(rawURL string) string {
+	for _, m := range p.Merge {
+		if m.URL == rawURL {
+			return m.Format
+		}
+	}
+	return p.Format
+}
@@ -0,0 +1,102 @@
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestFetchMerged(t *testing.T) {
+	parspack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer parspack.Close()
+
+	var failing bool
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ipv4": ["173.245.48.0/20"], "ipv6": ["2400:cb00::/32"]}`))
+	}))
+	defer cdn.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("103.21.244.0/22\n"))
+	}))
+	defer other.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = parspack.URL
+	p.IPv6 = &disabled
+	p.MaxRetries = -1
+	p.Merge = []MergeSource{{URL: cdn.URL}, {URL: other.URL, Format: formatText}}
+
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	want := prefixes("103.21.244.0/22", "173.245.48.0/20", "185.8.172.0/22", "2400:cb00::/32")
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if got := p.status().Sources["173.245.48.0/20"]; got != cdn.URL {
+		t.Errorf("source = %q, want the merged URL", got)
+	}
+
+	// A failing merged list keeps its previous ranges
+	failing = true
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() with a failing merged list error = %v", err)
+	}
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want previous %v", got, want)
+	}
+}
+
+func TestFetchMergedPrimaryFails(t *testing.T) {
+	var failing bool
+	parspack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer parspack.Close()
+	cdnRange := "173.245.48.0/20"
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(cdnRange + "\n"))
+	}))
+	defer cdn.Close()
+
+	disabled := false
+	p := newTestSource()
+	p.URL = parspack.URL
+	p.IPv6 = &disabled
+	p.MaxRetries = -1
+	p.OnError = onErrorClear
+	p.Merge = []MergeSource{{URL: cdn.URL, Format: formatText}}
+
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+
+	// A failing ParsPack fetch clears its own ranges only, and the merged
+	// list keeps refreshing
+	failing = true
+	cdnRange = "103.21.244.0/22"
+	if err := p.fetchIPRanges(context.Background()); err == nil {
+		t.Fatal("fetchIPRanges() with a failing ParsPack list succeeded")
+	}
+	want := prefixes("103.21.244.0/22")
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want the merged %v", got, want)
+	}
+	if got := p.status().Sources["103.21.244.0/22"]; got != cdn.URL {
+		t.Errorf("source = %q, want the merged URL", got)
+	}
+}
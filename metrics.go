@@ -0,0 +1,141 @@
+package parspackip
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var parspackMetrics = struct {
+	once          sync.Once
+	fetchTotal    *prometheus.CounterVec
+	sources       prometheus.Collector
+	fetchDuration prometheus.Histogram
+}{}
+
+// initMetrics creates the module's collectors once and registers them with
+// the registry of the current config
+func initMetrics(registry *prometheus.Registry) error {
+	const ns = "parspack"
+
+	parspackMetrics.once.Do(func() {
+		parspackMetrics.fetchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "fetch_total",
+			Help:      "Number of ParsPack IP range refreshes by result.",
+		}, []string{"result"})
+		parspackMetrics.sources = &sourcesCollector{
+			count: prometheus.NewDesc(prometheus.BuildFQName(ns, "", "ranges_count"),
+				"Number of ParsPack IP ranges currently loaded, by source.",
+				[]string{"source"}, nil),
+			age: prometheus.NewDesc(prometheus.BuildFQName(ns, "", "ranges_age_seconds"),
+				"Seconds since the ParsPack IP ranges of a source were last fetched successfully.",
+				[]string{"source"}, nil),
+		}
+		parspackMetrics.fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "fetch_duration_seconds",
+			Help:      "Duration of HTTP requests fetching a ParsPack IP list.",
+			Buckets:   prometheus.DefBuckets,
+		})
+	})
+
+	if registry == nil {
+		return nil
+	}
+
+	// Several instances may share one config, so registering the same
+	// collectors again is expected and ignored
+	for _, c := range []prometheus.Collector{
+		parspackMetrics.fetchTotal,
+		parspackMetrics.sources,
+		parspackMetrics.fetchDuration,
+	} {
+		if err := registry.Register(c); err != nil &&
+			!errors.Is(err, prometheus.AlreadyRegisteredError{ExistingCollector: c, NewCollector: c}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeFetch records the result of a refresh
+func observeFetch(err error) {
+	if parspackMetrics.fetchTotal == nil {
+		return
+	}
+	if err != nil {
+		parspackMetrics.fetchTotal.WithLabelValues("error").Inc()
+		return
+	}
+	parspackMetrics.fetchTotal.WithLabelValues("success").Inc()
+}
+
+// observeFetchDuration records how long a single HTTP fetch took
+func observeFetchDuration(seconds float64) {
+	if parspackMetrics.fetchDuration == nil {
+		return
+	}
+	parspackMetrics.fetchDuration.Observe(seconds)
+}
+
+// sourcesCollector reports the range count and age of every running
+// source, labeled with its url (or file), when scraped. Sources that are no
+// longer loaded thus disappear from the metrics with their config.
+type sourcesCollector struct {
+	count, age *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (c *sourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.count
+	ch <- c.age
+}
+
+// Collect implements prometheus.Collector
+func (c *sourcesCollector) Collect(ch chan<- prometheus.Metric) {
+	for source, m := range sourceMetrics() {
+		ch <- prometheus.MustNewConstMetric(c.count, prometheus.GaugeValue, float64(m.count), source)
+		if m.aging {
+			ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, m.age.Seconds(), source)
+		}
+	}
+}
+
+// sourceMetric is the state of a source reported in the metrics
+type sourceMetric struct {
+	count int
+	age   time.Duration
+	aging bool
+}
+
+// sourceMetrics returns the state of the running sources by label. The age
+// is measured like max_stale: since the last successful fetch, or since
+// startup before the first one. Static-only sources never age. Differently
+// configured sources of the same list are reported once, with the largest
+// count and the stalest age.
+func sourceMetrics() map[string]sourceMetric {
+	instances.Lock()
+	defer instances.Unlock()
+
+	metrics := make(map[string]sourceMetric)
+	for _, p := range instances.list {
+		p = p.source()
+		label := p.URL
+		if p.File != "" {
+			label = p.File
+		}
+		m := metrics[label]
+		p.mu.RLock()
+		m.count = max(m.count, len(p.ipRanges))
+		if !p.StaticOnly {
+			m.age = max(m.age, p.ageLocked())
+			m.aging = true
+		}
+		p.mu.RUnlock()
+		metrics[label] = m
+	}
+	return metrics
+}
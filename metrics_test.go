@@ -0,0 +1,52 @@
+package parspackip
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSourceMetrics(t *testing.T) {
+	fresh := &ParspackIPRange{URL: ipv4URL, lastFetch: time.Now().Add(-time.Minute), ipRanges: []netip.Prefix{netip.MustParsePrefix("185.8.172.0/22")}}
+	stale := &ParspackIPRange{URL: ipv4URL, Collapse: true, lastFetch: time.Now().Add(-time.Hour)}
+	mirror := &ParspackIPRange{URL: "https://mirror.example.com/cdnips.txt", lastFetch: time.Now().Add(-2 * time.Minute)}
+	static := &ParspackIPRange{URL: "https://static.example.com", StaticOnly: true, started: time.Now().Add(-24 * time.Hour)}
+	for _, p := range []*ParspackIPRange{fresh, stale, mirror, static} {
+		registerInstance(p)
+		defer unregisterInstance(p)
+	}
+
+	metrics := sourceMetrics()
+	if len(metrics) != 3 {
+		t.Fatalf("got metrics for %d sources, want 3: %+v", len(metrics), metrics)
+	}
+	// Sources of the same list report the largest count and stalest age
+	if m := metrics[ipv4URL]; m.count != 1 || m.age < time.Hour || m.age > time.Hour+time.Minute {
+		t.Errorf("metrics of %s = %+v, want 1 range about an hour old", ipv4URL, m)
+	}
+	if m := metrics[mirror.URL]; m.age < 2*time.Minute || m.age > 3*time.Minute {
+		t.Errorf("metrics of the mirror = %+v, want about 2m old", m)
+	}
+	if m := metrics[static.URL]; m.aging {
+		t.Errorf("static source reports an age: %+v", m)
+	}
+}
+
+func TestInitMetricsConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := initMetrics(registry); err != nil {
+		t.Fatalf("initMetrics() error = %v", err)
+	}
+	if err := initMetrics(registry); err != nil {
+		t.Fatalf("initMetrics() again error = %v, want registering twice to be ignored", err)
+	}
+
+	// A different collector with the same name is an error, not a panic
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "parspack_fetch_total", Help: "other"}))
+	if err := initMetrics(registry); err == nil {
+		t.Error("expected error for a conflicting collector")
+	}
+}
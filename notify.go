@@ -0,0 +1,108 @@
+package parspackip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Events accepted by NotifyOn
+const (
+	notifyAlways = "always"
+	notifyChange = "change"
+	notifyError  = "error"
+)
+
+// notification is the JSON payload posted to NotifyURL after a refresh
+type notification struct {
+	URL    string `json:"url"`
+	Status string `json:"status"`
+
+	// Count is the number of ranges served after the refresh, additional
+	// and merged ones included, whether it succeeded or not
+	Count int `json:"count"`
+
+	Changed   bool      `json:"changed"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// notify posts the outcome of a refresh to NotifyURL, if it is one of the
+// NotifyOn events. It doesn't wait for the webhook, which gets Timeout to
+// answer, so a slow one never delays refreshing; Cleanup waits for it.
+func (p *ParspackIPRange) notify(err error, changed bool, count int) {
+	if p.NotifyURL == "" {
+		return
+	}
+	switch p.NotifyOn {
+	case notifyChange:
+		if !changed {
+			return
+		}
+	case notifyError:
+		if err == nil {
+			return
+		}
+	}
+
+	n := notification{
+		URL:       p.URL,
+		Status:    "ok",
+		Count:     count,
+		Changed:   changed,
+		Timestamp: p.now().UTC(),
+	}
+	if err != nil {
+		n.Status = "error"
+		n.Error = err.Error()
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		p.log().Error("failed to encode refresh notification", zap.Error(err))
+		return
+	}
+
+	// Stopping the instance cancels the notifications in flight
+	ctx := p.loopCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	p.goTracked(func() {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(p.Timeout))
+		defer cancel()
+		if err := p.postNotification(ctx, body); err != nil {
+			p.log().Warn("failed to send refresh notification",
+				zap.String("notify_url", p.NotifyURL),
+				zap.Error(err))
+		}
+	})
+}
+
+// postNotification posts body to NotifyURL
+func (p *ParspackIPRange) postNotification(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", p.userAgent())
+
+	client := p.notifyClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package parspackip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestNotify(t *testing.T) {
+	list := "185.8.172.0/22\n"
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	received := make(chan notification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding notification: %v", err)
+		}
+		received <- n
+	}))
+	defer hook.Close()
+
+	tests := []struct {
+		notifyOn string
+		// Statuses posted for the initial, unchanged, failed and changed
+		// refreshes, in order, and the served range counts they report
+		want   []string
+		counts []int
+	}{
+		{notifyOn: notifyAlways, want: []string{"ok", "ok", "error", "ok"}, counts: []int{2, 2, 2, 3}},
+		{notifyOn: notifyChange, want: []string{"ok", "ok"}, counts: []int{2, 3}},
+		{notifyOn: notifyError, want: []string{"error"}, counts: []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.notifyOn, func(t *testing.T) {
+			p := newTestSource()
+			p.URL = srv.URL
+			p.IPv6 = new(bool)
+			p.MaxRetries = -1
+			p.Timeout = caddy.Duration(time.Second)
+			p.NotifyURL = hook.URL
+			p.NotifyOn = tt.notifyOn
+			// Counted on success as on failure
+			p.additional = prefixes("203.0.113.0/24")
+
+			var got []notification
+			// Notifications are sent in the background, wait for each
+			// refresh's before the next so that they arrive in order
+			refresh := func(wantErr bool) {
+				t.Helper()
+				if err := p.fetchIPRanges(context.Background()); (err != nil) != wantErr {
+					t.Fatalf("fetchIPRanges() error = %v, wantErr %v", err, wantErr)
+				}
+				select {
+				case n := <-received:
+					got = append(got, n)
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+
+			list, failing = "185.8.172.0/22\n", false
+			refresh(false)
+			refresh(false)
+			failing = true
+			refresh(true)
+			list, failing = "185.8.172.0/22\n195.248.240.0/22\n", false
+			refresh(false)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d notifications %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, n := range got {
+				if n.Status != tt.want[i] {
+					t.Errorf("notification %d status = %q, want %q", i, n.Status, tt.want[i])
+				}
+				if n.URL != srv.URL || n.Timestamp.IsZero() {
+					t.Errorf("notification %d = %+v, want the list URL and a timestamp", i, n)
+				}
+				if n.Count != tt.counts[i] {
+					t.Errorf("notification %d count = %d, want %d served ranges", i, n.Count, tt.counts[i])
+				}
+				if (n.Status == "error") != (n.Error != "") {
+					t.Errorf("notification %d has status %q and error %q", i, n.Status, n.Error)
+				}
+			}
+			if last := got[len(got)-1]; tt.notifyOn != notifyError && !last.Changed {
+				t.Errorf("last notification = %+v, want changed ranges", last)
+			}
+		})
+	}
+}
+
+func TestNotifyCleanup(t *testing.T) {
+	var received atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		received.Add(1)
+	}))
+	defer hook.Close()
+
+	p := newTestSource()
+	p.Timeout = caddy.Duration(time.Second)
+	p.NotifyURL = hook.URL
+	p.NotifyOn = notifyAlways
+	// The webhook doesn't go through the client of the list endpoint,
+	// with its certificates, proxy and TLS settings
+	p.client = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("list client used for the webhook")
+	})}
+
+	p.notify(nil, true, 1)
+	p.stop()
+	if got := received.Load(); got != 1 {
+		t.Fatalf("got %d notifications once stopped, want stop to wait for the one in flight", got)
+	}
+
+	// Nothing is sent once stopped
+	p.notify(nil, true, 1)
+	time.Sleep(100 * time.Millisecond)
+	if got := received.Load(); got != 1 {
+		t.Errorf("got %d notifications, want none after stop", got)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
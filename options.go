@@ -0,0 +1,60 @@
+package parspackip
+
+import (
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Option configures a ParspackIPRange created with New
+type Option func(*ParspackIPRange)
+
+// New creates a ParspackIPRange for programmatic use, without going through
+// Caddyfile or JSON parsing. The returned value still has to be provisioned
+// like any other Caddy module.
+func New(opts ...Option) *ParspackIPRange {
+	p := new(ParspackIPRange)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithURL sets the URL the IPv4 list is fetched from
+func WithURL(url string) Option {
+	return func(p *ParspackIPRange) {
+		p.URL = url
+	}
+}
+
+// WithInterval sets how often the IP list is refreshed
+func WithInterval(interval time.Duration) Option {
+	return func(p *ParspackIPRange) {
+		p.Interval = caddy.Duration(interval)
+	}
+}
+
+// WithTimeout sets the maximum time to wait for a response
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *ParspackIPRange) {
+		p.Timeout = caddy.Duration(timeout)
+	}
+}
+
+// WithLogger sets the logger used instead of the one Caddy provides during
+// provisioning
+func WithLogger(logger *zap.Logger) Option {
+	return func(p *ParspackIPRange) {
+		p.logger = logger
+	}
+}
+
+// WithTransformer adds a Transformer that post-processes the fetched ranges.
+// Transformers run in the order they were added, before any configured as
+// modules.
+func WithTransformer(t Transformer) Option {
+	return func(p *ParspackIPRange) {
+		p.transformers = append(p.transformers, t)
+	}
+}
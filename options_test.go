@@ -0,0 +1,31 @@
+package parspackip
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestNew(t *testing.T) {
+	logger := zap.NewNop()
+	p := New(
+		WithURL("https://mirror.example.com/cdnips.txt"),
+		WithInterval(2*time.Hour),
+		WithTimeout(10*time.Second),
+		WithLogger(logger),
+	)
+
+	if p.URL != "https://mirror.example.com/cdnips.txt" {
+		t.Errorf("URL = %q", p.URL)
+	}
+	if time.Duration(p.Interval) != 2*time.Hour {
+		t.Errorf("Interval = %v, want 2h", time.Duration(p.Interval))
+	}
+	if time.Duration(p.Timeout) != 10*time.Second {
+		t.Errorf("Timeout = %v, want 10s", time.Duration(p.Timeout))
+	}
+	if p.logger != logger {
+		t.Error("logger was not set")
+	}
+}
@@ -0,0 +1,107 @@
+package parspackip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// loadOverrideFiles reads the AdditionalFiles and ExcludeFiles and rebuilds
+// the served ranges if any of them changed. A file that can't be read keeps
+// the ranges last read from it; with initial set, it fails instead, so that
+// a mistyped path is reported when the config is loaded.
+func (p *ParspackIPRange) loadOverrideFiles(initial bool) error {
+	if len(p.AdditionalFiles) == 0 && len(p.ExcludeFiles) == 0 {
+		return nil
+	}
+
+	p.mu.RLock()
+	prevAdditional, prevExclude := p.fileIncludes, p.fileExcludes
+	p.mu.RUnlock()
+
+	additional, err := p.readOverrideFiles(p.AdditionalFiles, prevAdditional, initial)
+	if err != nil {
+		return fmt.Errorf("additional_file: %w", err)
+	}
+	exclude, err := p.readOverrideFiles(p.ExcludeFiles, prevExclude, initial)
+	if err != nil {
+		return fmt.Errorf("exclude_file: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if overridesEqual(p.fileIncludes, additional) && overridesEqual(p.fileExcludes, exclude) {
+		return nil
+	}
+	p.fileIncludes = additional
+	p.fileExcludes = exclude
+	p.rebuildLocked()
+	if !initial {
+		p.log().Info("override files changed",
+			zap.Strings("additional_files", p.AdditionalFiles),
+			zap.Strings("exclude_files", p.ExcludeFiles))
+	}
+	return nil
+}
+
+// readOverrideFiles reads the ranges of each of paths, falling back to
+// those in prev for the files that can't be read unless initial is set
+func (p *ParspackIPRange) readOverrideFiles(paths []string, prev map[string][]netip.Prefix, initial bool) (map[string][]netip.Prefix, error) {
+	files := make(map[string][]netip.Prefix, len(paths))
+	for _, path := range paths {
+		ranges, err := p.readOverrideFile(path)
+		if err != nil {
+			if initial {
+				return nil, err
+			}
+			p.log().Warn("failed to read override file, keeping its previous ranges",
+				zap.String("file", path),
+				zap.Error(err))
+			ranges = prev[path]
+		}
+		files[path] = ranges
+	}
+	return files, nil
+}
+
+// readOverrideFile reads a file of CIDRs or address spans, one per line.
+// Unlike fetched lists, its ranges aren't filtered by the prefix length
+// bounds or drop_private, like Additional and Exclude. Lines that don't
+// parse are logged and skipped.
+func (p *ParspackIPRange) readOverrideFile(path string) ([]netip.Prefix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []netip.Prefix
+	for line := range scanRanges(string(data)) {
+		if line.err != nil {
+			p.log().Warn("failed to parse IP range in override file",
+				zap.String("file", path),
+				zap.Int("line", line.num),
+				zap.String("range", line.text),
+				zap.Error(line.err))
+			continue
+		}
+		ranges = append(ranges, line.prefixes...)
+	}
+	return ranges, nil
+}
+
+// overridesEqual reports whether two sets of override file ranges are the
+// same
+func overridesEqual(a, b map[string][]netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, ranges := range a {
+		other, ok := b[path]
+		if !ok || !slices.Equal(ranges, other) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoadOverrideFiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	additional := filepath.Join(dir, "additional.txt")
+	exclude := filepath.Join(dir, "exclude.txt")
+	write := func(path, text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(additional, "# office\r10.0.0.0/8\r\nnot-a-range\n192.168.1.0-192.168.1.255 # lab\n")
+	write(exclude, "185.8.173.0/24\n")
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	p := newTestSource()
+	p.logger = zap.New(core)
+	p.URL = srv.URL
+	p.IPv6 = new(bool)
+	p.AdditionalFiles = []string{additional}
+	p.ExcludeFiles = []string{exclude}
+
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	want := prefixes("10.0.0.0/8", "185.8.172.0/24", "185.8.174.0/23", "192.168.1.0/24")
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if got := logs.FilterMessage("failed to parse IP range in override file").Len(); got != 1 {
+		t.Errorf("logged %d parse warnings, want 1", got)
+	}
+	if got := p.status().Sources["10.0.0.0/8"]; got != additional {
+		t.Errorf("source = %q, want the file", got)
+	}
+
+	// The files are read again on refresh
+	write(exclude, "")
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	want = prefixes("10.0.0.0/8", "185.8.172.0/22", "192.168.1.0/24")
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() after editing = %v, want %v", got, want)
+	}
+
+	// A file that disappears keeps its previous ranges
+	if err := os.Remove(additional); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() after removal = %v, want %v", got, want)
+	}
+	if logs.FilterMessage("failed to read override file, keeping its previous ranges").Len() != 1 {
+		t.Error("expected the missing file to be logged")
+	}
+
+	// But is an error when the config is loaded
+	p = newTestSource()
+	p.AdditionalFiles = []string{additional}
+	if err := p.loadOverrideFiles(true); err == nil {
+		t.Error("expected error for a missing file at startup")
+	}
+}
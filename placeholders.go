@@ -0,0 +1,135 @@
+package parspackip
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Placeholders{})
+	httpcaddyfile.RegisterHandlerDirective("parspack_placeholders", parsePlaceholders)
+	httpcaddyfile.RegisterDirectiveOrder("parspack_placeholders", httpcaddyfile.Before, "header")
+}
+
+// Placeholders is an HTTP handler that exposes the state of the ParsPack IP
+// source as placeholders, for use in headers, responses or logs:
+//
+//	{http.parspack.range_count}  number of ranges currently loaded
+//	{http.parspack.last_update}  time of the last successful fetch (RFC 3339)
+//	{http.parspack.ready}        whether a fresh, non-empty list is loaded
+//	{http.parspack.trusted}      whether the client IP is within the ranges
+//
+// IP sources are not handed the request replacer, so the placeholders can
+// only be set by a handler in the route.
+type Placeholders struct {
+	// URL selects the source to report by its url option. By default,
+	// the most recently provisioned source is reported.
+	URL string `json:"url,omitempty"`
+
+	// src is the source reported, resolved once in Provision so that
+	// requests neither contend on the set of instances nor switch to
+	// another config's source during a reload
+	src *ParspackIPRange
+}
+
+// CaddyModule returns the Caddy module information
+func (Placeholders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.parspack_placeholders",
+		New: func() caddy.Module { return new(Placeholders) },
+	}
+}
+
+// Provision implements caddy.Provisioner. Sources are provisioned before
+// the handlers of their server, so a source in the same server as the
+// handler is always found.
+func (ph *Placeholders) Provision(ctx caddy.Context) error {
+	ph.src = findInstance(ph.URL)
+	if ph.src == nil {
+		ctx.Logger().Warn("no ParsPack IP source loaded, placeholders report no ranges",
+			zap.String("url", ph.URL))
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler
+func (ph Placeholders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	var count int
+	var lastFetch time.Time
+	var ready, trusted bool
+	if ph.src != nil {
+		p := ph.src.source()
+		p.mu.RLock()
+		count = len(p.ipRanges)
+		lastFetch = p.lastFetch
+		ready = p.readyLocked()
+		p.mu.RUnlock()
+		if addr, ok := clientAddr(r); ok {
+			trusted = p.Contains(addr)
+		}
+	}
+	repl.Set("http.parspack.trusted", trusted)
+	repl.Set("http.parspack.range_count", count)
+	repl.Set("http.parspack.ready", ready)
+	if !lastFetch.IsZero() {
+		repl.Set("http.parspack.last_update", lastFetch.Format(time.RFC3339))
+	} else {
+		repl.Set("http.parspack.last_update", "")
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// clientAddr returns the client IP of r as determined by the server, which
+// is the peer address unless it is a trusted proxy, in which case it is
+// taken from the forwarding headers
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	ip, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if ip == "" {
+		addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		return addrPort.Addr(), true
+	}
+	addr, err := netip.ParseAddr(ip)
+	return addr, err == nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	parspack_placeholders [<url>]
+func (ph *Placeholders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip directive name
+	if d.NextArg() {
+		ph.URL = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parsePlaceholders(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var ph Placeholders
+	err := ph.UnmarshalCaddyfile(h.Dispenser)
+	return ph, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Placeholders)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Placeholders)(nil)
+	_ caddyfile.Unmarshaler       = (*Placeholders)(nil)
+)
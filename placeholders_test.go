@@ -0,0 +1,140 @@
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPlaceholders(t *testing.T) {
+	lastFetch := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := &ParspackIPRange{
+		URL:       ipv4URL,
+		ipRanges:  []netip.Prefix{netip.MustParsePrefix("185.8.172.0/22")},
+		lastFetch: lastFetch,
+	}
+	ph := Placeholders{src: p}
+
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+	var got string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		got = repl.ReplaceAll("{http.parspack.range_count} {http.parspack.last_update} {http.parspack.ready}", "")
+		return nil
+	})
+	if err := ph.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatalf("ServeHTTP() error = %v", err)
+	}
+	if want := "1 2024-01-01T12:00:00Z false"; got != want {
+		t.Errorf("placeholders = %q, want %q", got, want)
+	}
+}
+
+func TestPlaceholdersTrusted(t *testing.T) {
+	p := newTestSource()
+	p.fetched = prefixes("185.8.172.0/22")
+	p.rebuildLocked()
+	ph := Placeholders{src: p}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		clientIP   string
+		want       string
+	}{
+		{name: "peer in ranges", remoteAddr: "185.8.172.10:443", want: "true"},
+		{name: "peer outside ranges", remoteAddr: "203.0.113.5:443", want: "false"},
+		// The client IP set by the server wins over the peer address
+		{name: "client ip in ranges", remoteAddr: "203.0.113.5:443", clientIP: "185.8.173.1", want: "true"},
+		{name: "client ip outside ranges", remoteAddr: "185.8.172.10:443", clientIP: "203.0.113.5", want: "false"},
+		{name: "unix socket", remoteAddr: "@", want: "false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := caddy.NewReplacer()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+			ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+			r = r.WithContext(ctx)
+			if tt.clientIP != "" {
+				caddyhttp.SetVar(ctx, caddyhttp.ClientIPVarKey, tt.clientIP)
+			}
+
+			var got string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				got = repl.ReplaceAll("{http.parspack.trusted}", "")
+				return nil
+			})
+			if err := ph.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("{http.parspack.trusted} = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholdersTrustedSelectsSource(t *testing.T) {
+	parspack := newTestSource()
+	parspack.URL = ipv4URL
+	parspack.fetched = prefixes("185.8.172.0/22")
+	parspack.rebuildLocked()
+	registerInstance(parspack)
+	defer unregisterInstance(parspack)
+
+	// Provisioned last, so it would be reported by default
+	mirror := newTestSource()
+	mirror.URL = "https://mirror.example.com/cdnips.txt"
+	mirror.fetched = prefixes("203.0.113.0/24")
+	mirror.rebuildLocked()
+	registerInstance(mirror)
+	defer unregisterInstance(mirror)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: ipv4URL, want: "true false"},
+		{url: mirror.URL, want: "false true"},
+		{url: "", want: "false true"},
+	}
+	for _, tt := range tests {
+		ph := Placeholders{URL: tt.url}
+		if err := ph.Provision(ctx); err != nil {
+			t.Fatalf("Provision() error = %v", err)
+		}
+
+		var got []string
+		for _, remoteAddr := range []string{"185.8.172.10:443", "203.0.113.5:443"} {
+			repl := caddy.NewReplacer()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = remoteAddr
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				got = append(got, repl.ReplaceAll("{http.parspack.trusted}", ""))
+				return nil
+			})
+			if err := ph.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+		}
+		if got := strings.Join(got, " "); got != tt.want {
+			t.Errorf("url %q: {http.parspack.trusted} = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
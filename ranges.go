@@ -0,0 +1,320 @@
+package parspackip
+
+import (
+	"fmt"
+	"iter"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// rangeLine is a line of a text list of ranges
+type rangeLine struct {
+	num      int
+	text     string
+	prefixes []netip.Prefix
+	err      error
+}
+
+// scanRanges yields the lines of a text list holding a range, parsed into
+// prefixes, skipping blank lines and # comments. Lines that don't parse are
+// yielded with err set.
+func scanRanges(text string) iter.Seq[rangeLine] {
+	return func(yield func(rangeLine) bool) {
+		// Lists saved on Windows may start with a UTF-8 BOM and use CRLF
+		// or bare CR line endings
+		text = strings.TrimPrefix(text, "\ufeff")
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		text = strings.ReplaceAll(text, "\r", "\n")
+
+		num := 0
+		for line := range strings.SplitSeq(text, "\n") {
+			num++
+			// Drop trailing annotations like "1.2.3.0/24 # tehran pop"
+			if before, _, ok := strings.Cut(line, "#"); ok {
+				line = before
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			l := rangeLine{num: num, text: line}
+			if startStr, endStr, ok := strings.Cut(line, "-"); ok {
+				// Spans like 1.2.3.0-1.2.3.255 are converted to covering
+				// prefixes
+				l.prefixes, l.err = parseSpan(strings.TrimSpace(startStr), strings.TrimSpace(endStr))
+			} else if prefix, err := caddyhttp.CIDRExpressionToPrefix(line); err != nil {
+				l.err = err
+			} else {
+				// Clients are matched as plain IPv4, so mapped ranges must
+				// be too
+				l.prefixes = []netip.Prefix{unmapPrefix(prefix)}
+			}
+			if !yield(l) {
+				return
+			}
+		}
+	}
+}
+
+// ipv6Only returns the IPv6 prefixes of ranges
+func ipv6Only(ranges []netip.Prefix) []netip.Prefix {
+	var v6 []netip.Prefix
+	for _, prefix := range ranges {
+		if prefix.Addr().Is6() {
+			v6 = append(v6, prefix)
+		}
+	}
+	return v6
+}
+
+// reservedRanges are the private and special-purpose address blocks that
+// must never be trusted as CDN addresses
+var reservedRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/127"),          // unspecified and loopback
+	netip.MustParsePrefix("::ffff:0:0/96"),   // IPv4-mapped
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use IPv4/IPv6 translation
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// isReserved reports whether prefix overlaps a reserved range, either
+// falling within one or covering one like 0.0.0.0/0 does
+func isReserved(prefix netip.Prefix) bool {
+	return slices.ContainsFunc(reservedRanges, prefix.Overlaps)
+}
+
+// unmapPrefix converts an IPv4-mapped IPv6 prefix, like ::ffff:1.2.3.0/120,
+// to the plain IPv4 prefix it covers. Other prefixes, including mapped ones
+// too short to fall within ::ffff:0:0/96, are returned unchanged.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+// comparePrefixes orders prefixes by address family, then address, then
+// prefix length with shorter (broader) prefixes first
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// dedupeRanges drops exact duplicate prefixes, keeping the order of first
+// occurrence. If collapse is set, prefixes fully contained in another one
+// are dropped as well and the result is sorted.
+func dedupeRanges(ranges []netip.Prefix, collapse bool) []netip.Prefix {
+	seen := make(map[netip.Prefix]struct{}, len(ranges))
+	unique := make([]netip.Prefix, 0, len(ranges))
+	for _, prefix := range ranges {
+		prefix = prefix.Masked()
+		if _, ok := seen[prefix]; ok {
+			continue
+		}
+		seen[prefix] = struct{}{}
+		unique = append(unique, prefix)
+	}
+	if !collapse {
+		return unique
+	}
+
+	// Once sorted, a contained prefix always follows its container, and
+	// the kept prefixes are disjoint, so comparing against the last kept
+	// one is enough
+	slices.SortFunc(unique, comparePrefixes)
+	collapsed := unique[:0]
+	for _, prefix := range unique {
+		if n := len(collapsed); n > 0 && collapsed[n-1].Overlaps(prefix) &&
+			collapsed[n-1].Bits() <= prefix.Bits() {
+			continue
+		}
+		collapsed = append(collapsed, prefix)
+	}
+	return collapsed
+}
+
+// normalizeRanges returns ranges masked, sorted and without exact
+// duplicates. If merge is set, contained prefixes are dropped and adjacent
+// ones are merged as well, giving the minimal set of prefixes covering the
+// same addresses.
+func normalizeRanges(ranges []netip.Prefix, merge bool) []netip.Prefix {
+	normalized := dedupeRanges(ranges, merge)
+	if !merge {
+		slices.SortFunc(normalized, comparePrefixes)
+		return normalized
+	}
+
+	// The collapsed prefixes are sorted and disjoint, so two prefixes can
+	// only merge when they are neighbours on the stack. A merged parent
+	// may in turn pair up with the prefix before it.
+	merged := normalized[:0]
+	for _, prefix := range normalized {
+		for n := len(merged); n > 0; n = len(merged) {
+			parent, ok := mergeSiblings(merged[n-1], prefix)
+			if !ok {
+				break
+			}
+			merged, prefix = merged[:n-1], parent
+		}
+		merged = append(merged, prefix)
+	}
+	return merged
+}
+
+// mergeSiblings returns the parent of a and b if they are the two halves of
+// the same prefix, with a being the lower half
+func mergeSiblings(a, b netip.Prefix) (netip.Prefix, bool) {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().Is4() != b.Addr().Is4() {
+		return netip.Prefix{}, false
+	}
+	parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+	if parent.Addr() != a.Addr() || lastAddr(a).Next() != b.Addr() {
+		return netip.Prefix{}, false
+	}
+	return parent, true
+}
+
+// excludeRanges returns ranges with every address covered by exclude
+// removed. Prefixes partially covered by an exclusion are split into the
+// prefixes covering what remains.
+func excludeRanges(ranges, exclude []netip.Prefix) []netip.Prefix {
+	if len(exclude) == 0 {
+		return ranges
+	}
+	remaining := ranges
+	for _, excluded := range exclude {
+		excluded = excluded.Masked()
+		next := make([]netip.Prefix, 0, len(remaining))
+		for _, prefix := range remaining {
+			next = append(next, subtractPrefix(prefix.Masked(), excluded)...)
+		}
+		remaining = next
+	}
+	return remaining
+}
+
+// subtractPrefix returns the prefixes covering prefix minus excluded. Both
+// must be masked.
+func subtractPrefix(prefix, excluded netip.Prefix) []netip.Prefix {
+	if !prefix.Overlaps(excluded) {
+		return []netip.Prefix{prefix}
+	}
+	if excluded.Bits() <= prefix.Bits() {
+		return nil
+	}
+
+	// Halve prefix until reaching excluded, keeping at each step the half
+	// that doesn't contain it
+	var remaining []netip.Prefix
+	for prefix.Bits() < excluded.Bits() {
+		lower := netip.PrefixFrom(prefix.Addr(), prefix.Bits()+1)
+		upper := netip.PrefixFrom(lastAddr(lower).Next(), prefix.Bits()+1)
+		if lower.Contains(excluded.Addr()) {
+			remaining = append(remaining, upper)
+			prefix = lower
+		} else {
+			remaining = append(remaining, lower)
+			prefix = upper
+		}
+	}
+	return remaining
+}
+
+// diffRanges returns the prefixes present in next but not in prev, and
+// those present in prev but not in next
+func diffRanges(prev, next []netip.Prefix) (added, removed []netip.Prefix) {
+	prevSet := make(map[netip.Prefix]struct{}, len(prev))
+	for _, prefix := range prev {
+		prevSet[prefix] = struct{}{}
+	}
+	nextSet := make(map[netip.Prefix]struct{}, len(next))
+	for _, prefix := range next {
+		nextSet[prefix] = struct{}{}
+		if _, ok := prevSet[prefix]; !ok {
+			added = append(added, prefix)
+		}
+	}
+	for _, prefix := range prev {
+		if _, ok := nextSet[prefix]; !ok {
+			removed = append(removed, prefix)
+		}
+	}
+	return added, removed
+}
+
+// containsSorted reports whether addr falls within one of lookup, which must
+// be sorted and disjoint as returned by dedupeRanges with collapse set
+func containsSorted(lookup []netip.Prefix, addr netip.Addr) bool {
+	i, found := slices.BinarySearchFunc(lookup, addr, func(prefix netip.Prefix, addr netip.Addr) int {
+		return prefix.Addr().Compare(addr)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && lookup[i-1].Contains(addr)
+}
+
+// lastAddr returns the highest address within prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// rangeToPrefixes converts the inclusive span start-end into the minimal
+// set of prefixes covering exactly that span
+func rangeToPrefixes(start, end netip.Addr) ([]netip.Prefix, error) {
+	if start.Is4() != end.Is4() {
+		return nil, fmt.Errorf("%s and %s are not of the same address family", start, end)
+	}
+	if start.Compare(end) > 0 {
+		return nil, fmt.Errorf("start %s is after end %s", start, end)
+	}
+
+	var prefixes []netip.Prefix
+	for {
+		// Pick the broadest prefix that starts at start and ends no later
+		// than end
+		var prefix netip.Prefix
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			candidate := netip.PrefixFrom(start, bits).Masked()
+			if candidate.Addr() == start && lastAddr(candidate).Compare(end) <= 0 {
+				prefix = candidate
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes, nil
+		}
+		start = last.Next()
+	}
+}
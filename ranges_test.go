@@ -0,0 +1,355 @@
+package parspackip
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	ranges := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ranges = append(ranges, netip.MustParsePrefix(cidr))
+	}
+	return ranges
+}
+
+func TestDiffRanges(t *testing.T) {
+	prev := prefixes("185.8.172.0/22", "195.248.240.0/22")
+	next := prefixes("195.248.240.0/22", "2a0e:1c80::/32")
+
+	added, removed := diffRanges(prev, next)
+	if len(added) != 1 || added[0] != netip.MustParsePrefix("2a0e:1c80::/32") {
+		t.Errorf("added = %v, want [2a0e:1c80::/32]", added)
+	}
+	if len(removed) != 1 || removed[0] != netip.MustParsePrefix("185.8.172.0/22") {
+		t.Errorf("removed = %v, want [185.8.172.0/22]", removed)
+	}
+
+	added, removed = diffRanges(next, next)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("diff of identical lists = %v, %v; want none", added, removed)
+	}
+}
+
+func TestDedupeRanges(t *testing.T) {
+	input := prefixes(
+		"185.8.172.0/22",
+		"185.8.172.0/24",
+		"185.8.172.0/22",
+		"10.0.0.1/8",
+		"195.248.240.0/22",
+		"2a0e:1c80::/32",
+		"2a0e:1c80:1::/48",
+	)
+
+	got := dedupeRanges(input, false)
+	want := prefixes("185.8.172.0/22", "185.8.172.0/24", "10.0.0.0/8", "195.248.240.0/22", "2a0e:1c80::/32", "2a0e:1c80:1::/48")
+	if !slices.Equal(got, want) {
+		t.Errorf("dedupeRanges(collapse=false) = %v, want %v", got, want)
+	}
+
+	got = dedupeRanges(input, true)
+	want = prefixes("10.0.0.0/8", "185.8.172.0/22", "195.248.240.0/22", "2a0e:1c80::/32")
+	if !slices.Equal(got, want) {
+		t.Errorf("dedupeRanges(collapse=true) = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeRanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []netip.Prefix
+		merge bool
+		want  []netip.Prefix
+	}{
+		{
+			name:  "sorts and dedupes",
+			input: prefixes("195.248.240.0/22", "185.8.172.0/24", "185.8.172.1/24", "2a0e:1c80::/32", "10.0.0.0/8"),
+			want:  prefixes("10.0.0.0/8", "185.8.172.0/24", "195.248.240.0/22", "2a0e:1c80::/32"),
+		},
+		{
+			name:  "keeps overlaps without merge",
+			input: prefixes("185.8.173.0/24", "185.8.172.0/22", "185.8.172.0/24"),
+			want:  prefixes("185.8.172.0/22", "185.8.172.0/24", "185.8.173.0/24"),
+		},
+		{
+			name:  "merges adjacent",
+			input: prefixes("185.8.173.0/24", "185.8.172.0/24", "2a0e:1c80:1::/48", "2a0e:1c80::/48"),
+			merge: true,
+			want:  prefixes("185.8.172.0/23", "2a0e:1c80::/47"),
+		},
+		{
+			name:  "merges repeatedly",
+			input: prefixes("185.8.172.0/24", "185.8.173.0/24", "185.8.174.0/23", "185.8.176.0/24"),
+			merge: true,
+			want:  prefixes("185.8.172.0/22", "185.8.176.0/24"),
+		},
+		{
+			name:  "drops contained before merging",
+			input: prefixes("10.0.0.0/25", "10.0.0.0/24", "10.0.1.128/25", "10.0.1.0/24"),
+			merge: true,
+			want:  prefixes("10.0.0.0/23"),
+		},
+		{
+			name:  "does not merge non-siblings",
+			input: prefixes("10.0.1.0/24", "10.0.2.0/24"),
+			merge: true,
+			want:  prefixes("10.0.1.0/24", "10.0.2.0/24"),
+		},
+		{
+			name:  "does not merge across families",
+			input: prefixes("255.255.255.255/32", "::/128"),
+			merge: true,
+			want:  prefixes("255.255.255.255/32", "::/128"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeRanges(tt.input, tt.merge); !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []netip.Prefix
+		exclude []netip.Prefix
+		want    []netip.Prefix
+	}{
+		{
+			name:    "no overlap",
+			ranges:  prefixes("185.8.172.0/22"),
+			exclude: prefixes("10.0.0.0/8", "2a0e:1c80::/32"),
+			want:    prefixes("185.8.172.0/22"),
+		},
+		{
+			name:    "whole prefix",
+			ranges:  prefixes("185.8.172.0/24", "195.248.240.0/22"),
+			exclude: prefixes("185.8.172.0/22"),
+			want:    prefixes("195.248.240.0/22"),
+		},
+		{
+			name:    "lower half",
+			ranges:  prefixes("185.8.172.0/22"),
+			exclude: prefixes("185.8.172.0/23"),
+			want:    prefixes("185.8.174.0/23"),
+		},
+		{
+			name:    "deep split",
+			ranges:  prefixes("185.8.172.0/22"),
+			exclude: prefixes("185.8.173.4/32"),
+			want: prefixes(
+				"185.8.174.0/23", "185.8.172.0/24", "185.8.173.128/25", "185.8.173.64/26",
+				"185.8.173.32/27", "185.8.173.16/28", "185.8.173.8/29", "185.8.173.0/30",
+				"185.8.173.6/31", "185.8.173.5/32",
+			),
+		},
+		{
+			name:    "several exclusions",
+			ranges:  prefixes("10.0.0.0/24"),
+			exclude: prefixes("10.0.0.0/26", "10.0.0.192/26"),
+			want:    prefixes("10.0.0.128/26", "10.0.0.64/26"),
+		},
+		{
+			name:    "ipv6",
+			ranges:  prefixes("2a0e:1c80::/32"),
+			exclude: prefixes("2a0e:1c80:8000::/33"),
+			want:    prefixes("2a0e:1c80::/33"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := excludeRanges(tt.ranges, tt.exclude); !slices.Equal(got, tt.want) {
+				t.Errorf("excludeRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeRangesCoverage(t *testing.T) {
+	// Check address by address that exactly the excluded part of a small
+	// block is gone
+	ranges := prefixes("10.0.0.0/24")
+	exclude := prefixes("10.0.0.17/32", "10.0.0.64/27", "10.0.0.200/30")
+	lookup := normalizeRanges(excludeRanges(ranges, exclude), true)
+
+	for i := range 256 {
+		addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		excluded := slices.ContainsFunc(exclude, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+		if got := containsSorted(lookup, addr); got == excluded {
+			t.Errorf("contains(%s) = %v, want %v", addr, got, !excluded)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	p := &ParspackIPRange{
+		fetched:    prefixes("195.248.240.0/22", "185.8.172.0/22", "185.8.173.0/24", "2a0e:1c80::/32"),
+		additional: prefixes("10.1.0.0/16"),
+	}
+	p.rebuildLocked()
+
+	if !slices.IsSortedFunc(p.GetIPRanges(nil), comparePrefixes) {
+		t.Errorf("GetIPRanges() = %v, want sorted", p.GetIPRanges(nil))
+	}
+
+	// Callers get their own copy
+	p.GetIPRanges(nil)[0] = netip.MustParsePrefix("0.0.0.0/0")
+	if got := p.GetIPRanges(nil)[0]; got.Bits() == 0 {
+		t.Errorf("GetIPRanges() returned the internal slice, modified to %s", got)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"185.8.172.1", true},
+		{"185.8.175.255", true},
+		{"185.8.176.0", false},
+		{"195.248.241.161", true},
+		{"10.1.255.255", true},
+		{"10.2.0.0", false},
+		{"1.1.1.1", false},
+		{"255.255.255.255", false},
+		{"2a0e:1c80:ffff::1", true},
+		{"2a0f::1", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := p.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFamily(t *testing.T) {
+	tests := []struct {
+		family string
+		want   []netip.Prefix
+	}{
+		{family: familyBoth, want: prefixes("10.1.0.0/16", "185.8.172.0/22", "2a0e:1c80::/32", "fd00::/8")},
+		{family: familyV4, want: prefixes("10.1.0.0/16", "185.8.172.0/22")},
+		{family: familyV6, want: prefixes("2a0e:1c80::/32", "fd00::/8")},
+	}
+	for _, tt := range tests {
+		p := &ParspackIPRange{
+			Family:     tt.family,
+			fetched:    prefixes("185.8.172.0/22", "2a0e:1c80::/32"),
+			additional: prefixes("10.1.0.0/16", "fd00::/8"),
+		}
+		p.rebuildLocked()
+		if got := p.GetIPRanges(nil); !slices.Equal(got, tt.want) {
+			t.Errorf("family %s: GetIPRanges() = %v, want %v", tt.family, got, tt.want)
+		}
+		if got, want := p.ipv6Enabled(), tt.family != familyV4; got != want {
+			t.Errorf("family %s: ipv6Enabled() = %v, want %v", tt.family, got, want)
+		}
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"10.1.0.0/16", true},
+		{"172.20.0.0/16", true},
+		{"192.168.1.0/24", true},
+		{"127.0.0.1/32", true},
+		{"169.254.0.0/16", true},
+		{"100.64.0.0/10", true},
+		{"0.0.0.0/0", true},
+		{"8.0.0.0/7", false},
+		{"185.8.172.0/22", false},
+		{"fd00::/8", true},
+		{"fe80::/64", true},
+		{"::1/128", true},
+		{"::/0", true},
+		{"2a0e:1c80::/32", false},
+	}
+	for _, tt := range tests {
+		if got := isReserved(netip.MustParsePrefix(tt.in)); got != tt.want {
+			t.Errorf("isReserved(%s) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnmapPrefix(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"::ffff:1.2.3.0/120", "1.2.3.0/24"},
+		{"::ffff:1.2.3.4/128", "1.2.3.4/32"},
+		{"::ffff:0.0.0.0/96", "0.0.0.0/0"},
+		{"::ffff:0.0.0.0/95", "::ffff:0.0.0.0/95"},
+		{"1.2.3.0/24", "1.2.3.0/24"},
+		{"2a0e:1c80::/32", "2a0e:1c80::/32"},
+	}
+	for _, tt := range tests {
+		if got := unmapPrefix(netip.MustParsePrefix(tt.in)); got != netip.MustParsePrefix(tt.want) {
+			t.Errorf("unmapPrefix(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContainsMapped(t *testing.T) {
+	p := &ParspackIPRange{MaxParseWarnings: defaultMaxParseWarnings, logger: zap.NewNop()}
+	ranges, err := p.parseIPRanges("::ffff:185.8.172.0/118\n195.248.240.0/22\n::ffff:94.101.176.0-::ffff:94.101.191.255\n")
+	if err != nil {
+		t.Fatalf("parseIPRanges() error = %v", err)
+	}
+	if want := prefixes("185.8.172.0/22", "195.248.240.0/22", "94.101.176.0/20"); !slices.Equal(ranges, want) {
+		t.Errorf("parseIPRanges() = %v, want %v", ranges, want)
+	}
+	p.fetched = ranges
+	p.rebuildLocked()
+
+	// Mapped and plain client addresses match the same way, whichever
+	// form the range was published in
+	for _, addr := range []string{"185.8.172.1", "195.248.240.1", "94.101.180.1"} {
+		plain := netip.MustParseAddr(addr)
+		mapped := netip.AddrFrom16(plain.As16())
+		if !p.Contains(plain) || !p.Contains(mapped) {
+			t.Errorf("Contains(%s) = %v, Contains(%s) = %v, want both true", plain, p.Contains(plain), mapped, p.Contains(mapped))
+		}
+	}
+	if p.Contains(netip.MustParseAddr("::ffff:1.1.1.1")) {
+		t.Error("Contains(::ffff:1.1.1.1) = true, want false")
+	}
+}
+
+func TestRangeToPrefixes(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       []netip.Prefix
+		wantErr    bool
+	}{
+		{start: "1.2.3.0", end: "1.2.3.255", want: prefixes("1.2.3.0/24")},
+		{start: "1.2.3.4", end: "1.2.3.4", want: prefixes("1.2.3.4/32")},
+		{start: "1.2.3.1", end: "1.2.3.10", want: prefixes("1.2.3.1/32", "1.2.3.2/31", "1.2.3.4/30", "1.2.3.8/31", "1.2.3.10/32")},
+		{start: "0.0.0.0", end: "255.255.255.255", want: prefixes("0.0.0.0/0")},
+		{start: "255.255.255.254", end: "255.255.255.255", want: prefixes("255.255.255.254/31")},
+		{start: "2a0e:1c80::", end: "2a0e:1c80::ffff", want: prefixes("2a0e:1c80::/112")},
+		{start: "1.2.3.10", end: "1.2.3.1", wantErr: true},
+		{start: "1.2.3.0", end: "::1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := rangeToPrefixes(netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rangeToPrefixes(%s, %s) error = %v, wantErr %v", tt.start, tt.end, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("rangeToPrefixes(%s, %s) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package parspackip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+
+	// minResolveInterval is the shortest time between two lookups of the
+	// Resolve hostnames, however low their TTL
+	minResolveInterval = 30 * time.Second
+)
+
+// errNoAddresses is returned when a Resolve hostname has no A or AAAA record
+var errNoAddresses = errors.New("no A or AAAA records")
+
+// resolveLoop looks up the Resolve hostnames until ctx is cancelled. Each
+// lookup is repeated once the lowest TTL of its records has expired,
+// independently of the list refresh interval. A failed lookup keeps the
+// previous addresses and is retried after minResolveInterval.
+func (p *ParspackIPRange) resolveLoop(ctx context.Context) {
+	servers := p.nameservers
+	if servers == nil {
+		conf, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			p.log().Error("failed to read resolver config, hostnames will not be resolved",
+				zap.String("file", resolvConf),
+				zap.Error(err))
+			return
+		}
+		for _, server := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+
+	for {
+		wait := minResolveInterval
+		if p.isPaused() {
+			if !p.sleep(ctx, wait) {
+				return
+			}
+			continue
+		}
+
+		resolved, ttl, err := p.resolveHosts(ctx, servers)
+		if err != nil {
+			p.log().Warn("failed to resolve hostnames, keeping previous addresses", zap.Error(err))
+		} else {
+			wait = max(ttl, minResolveInterval)
+			p.mu.Lock()
+			changed := !maps.Equal(p.resolved, resolved)
+			p.resolved = resolved
+			if changed {
+				p.rebuildLocked()
+			}
+			p.mu.Unlock()
+			if changed {
+				p.log().Info("resolved addresses changed",
+					zap.Strings("hosts", p.Resolve),
+					zap.Int("count", len(resolved)))
+			}
+			if p.DisableRefresh {
+				return
+			}
+		}
+
+		if !p.sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// resolveHosts looks up the A and AAAA records of every Resolve hostname.
+// It returns each address as a host prefix mapped to the hostname it was
+// resolved from, along with the lowest TTL of the answers.
+func (p *ParspackIPRange) resolveHosts(ctx context.Context, servers []string) (map[netip.Prefix]string, time.Duration, error) {
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no nameservers configured")
+	}
+
+	resolved := make(map[netip.Prefix]string)
+	ttl := p.period()
+	for _, host := range p.Resolve {
+		found := false
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			addrs, addrTTL, err := p.query(ctx, servers, host, qtype)
+			if err != nil {
+				return nil, 0, fmt.Errorf("resolving %s: %w", host, err)
+			}
+			for _, addr := range addrs {
+				prefix := netip.PrefixFrom(addr, addr.BitLen())
+				if _, ok := resolved[prefix]; !ok {
+					resolved[prefix] = host
+				}
+			}
+			if len(addrs) > 0 {
+				found = true
+				ttl = min(ttl, addrTTL)
+			}
+		}
+		if !found {
+			return nil, 0, fmt.Errorf("resolving %s: %w", host, errNoAddresses)
+		}
+	}
+	return resolved, ttl, nil
+}
+
+// query asks the nameservers in order for the records of type qtype of
+// host, retrying over TCP when the UDP answer is truncated. It returns the
+// addresses found and the lowest TTL of the answer.
+func (p *ParspackIPRange) query(ctx context.Context, servers []string, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+
+	var errs []error
+	for _, server := range servers {
+		client := &dns.Client{Timeout: time.Duration(p.Timeout)}
+		resp, _, err := client.ExchangeContext(ctx, msg, server)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, _, err = client.ExchangeContext(ctx, msg, server)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			errs = append(errs, fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode]))
+			continue
+		}
+
+		var addrs []netip.Addr
+		var ttl time.Duration
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ip)
+			if !ok {
+				continue
+			}
+			rrTTL := time.Duration(rr.Header().Ttl) * time.Second
+			if len(addrs) == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+			addrs = append(addrs, addr.Unmap())
+		}
+		return addrs, ttl, nil
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+// validateHostname checks that a Resolve entry is a bare hostname
+func validateHostname(host string) error {
+	if host == "" || strings.ContainsAny(host, "/: ") {
+		return fmt.Errorf("invalid hostname %q", host)
+	}
+	return nil
+}
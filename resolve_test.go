@@ -0,0 +1,130 @@
+package parspackip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// newTestNameserver serves the given records over UDP and returns its
+// address. Names without records answer NXDOMAIN.
+func newTestNameserver(t *testing.T, records map[string][]dns.RR) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		rrs, ok := records[q.Name]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestResolveHosts(t *testing.T) {
+	server := newTestNameserver(t, map[string][]dns.RR{
+		"edge.example.com.": {
+			mustRR(t, "edge.example.com. 300 IN A 185.8.172.10"),
+			mustRR(t, "edge.example.com. 120 IN A 185.8.172.11"),
+			mustRR(t, "edge.example.com. 600 IN AAAA 2a0e:1c80::10"),
+		},
+		"v4.example.com.": {
+			mustRR(t, "v4.example.com. 3600 IN A 195.248.240.1"),
+		},
+	})
+
+	p := newTestSource()
+	p.Interval = caddy.Duration(time.Hour)
+	p.Timeout = caddy.Duration(time.Second)
+	p.Resolve = []string{"edge.example.com", "v4.example.com"}
+	resolved, ttl, err := p.resolveHosts(context.Background(), []string{server})
+	if err != nil {
+		t.Fatalf("resolveHosts() error = %v", err)
+	}
+	want := map[string]string{
+		"185.8.172.10/32":   "edge.example.com",
+		"185.8.172.11/32":   "edge.example.com",
+		"2a0e:1c80::10/128": "edge.example.com",
+		"195.248.240.1/32":  "v4.example.com",
+	}
+	if len(resolved) != len(want) {
+		t.Errorf("resolved %v, want %v", resolved, want)
+	}
+	for prefix, host := range resolved {
+		if want[prefix.String()] != host {
+			t.Errorf("%s resolved from %q, want %q", prefix, host, want[prefix.String()])
+		}
+	}
+	if ttl != 120*time.Second {
+		t.Errorf("ttl = %v, want the lowest TTL of 2m", ttl)
+	}
+
+	p.Resolve = []string{"missing.example.com"}
+	if _, _, err := p.resolveHosts(context.Background(), []string{server}); err == nil {
+		t.Error("expected error for NXDOMAIN")
+	}
+}
+
+func TestResolveHostsNoAddresses(t *testing.T) {
+	server := newTestNameserver(t, map[string][]dns.RR{
+		"txt.example.com.": {mustRR(t, `txt.example.com. 300 IN TXT "hello"`)},
+	})
+
+	p := newTestSource()
+	p.Timeout = caddy.Duration(time.Second)
+	p.Resolve = []string{"txt.example.com"}
+	if _, _, err := p.resolveHosts(context.Background(), []string{server}); !errors.Is(err, errNoAddresses) {
+		t.Errorf("resolveHosts() error = %v, want errNoAddresses", err)
+	}
+}
+
+func TestResolveLoop(t *testing.T) {
+	server := newTestNameserver(t, map[string][]dns.RR{
+		"edge.example.com.": {mustRR(t, "edge.example.com. 300 IN A 185.8.172.10")},
+	})
+
+	p := newTestSource()
+	p.Interval = caddy.Duration(time.Hour)
+	p.Timeout = caddy.Duration(time.Second)
+	p.Resolve = []string{"edge.example.com"}
+	p.nameservers = []string{server}
+	p.fetched = prefixes("195.248.240.0/22")
+	// Returns after the first successful lookup
+	p.DisableRefresh = true
+	p.resolveLoop(context.Background())
+
+	if got, want := p.GetIPRanges(nil), prefixes("185.8.172.10/32", "195.248.240.0/22"); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if got := p.status().Sources["185.8.172.10/32"]; got != "edge.example.com" {
+		t.Errorf("source = %q, want the hostname", got)
+	}
+}
@@ -0,0 +1,90 @@
+package parspackip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "03:00"},
+		{expr: "3:30"},
+		{expr: "0 3 * * *"},
+		{expr: "*/15 1-5 1,15 * 0"},
+		{expr: "0 3 * * 7"},
+		{expr: "0 0-23/6 * * *"},
+		{expr: "25:00", wantErr: true},
+		{expr: "03", wantErr: true},
+		{expr: "0 3 * *", wantErr: true},
+		{expr: "0 3 * * MON", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "0 3 0 * *", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseSchedule(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("parseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// Monday
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "03:00", want: time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{expr: "12:30", want: time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)},
+		{expr: "12:00", want: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)},
+		{expr: "*/20 * * * *", want: time.Date(2024, 1, 1, 12, 20, 0, 0, time.UTC)},
+		{expr: "0 3 * * 6", want: time.Date(2024, 1, 6, 3, 0, 0, 0, time.UTC)},
+		{expr: "0 3 * * 0", want: time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC)},
+		{expr: "0 3 * * 7", want: time.Date(2024, 1, 7, 3, 0, 0, 0, time.UTC)},
+		{expr: "0 0 1 3 *", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricted day of month and day of week match either
+		{expr: "0 3 15 * 3", want: time.Date(2024, 1, 3, 3, 0, 0, 0, time.UTC)},
+		{expr: "0 3 30 2 *", want: time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("parseSchedule() error = %v", err)
+			}
+			if got := s.next(now); !got.Equal(tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextDueSchedule(t *testing.T) {
+	s, err := parseSchedule("03:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ParspackIPRange{schedule: s}
+	due := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+
+	if got, want := p.nextDue(due, due.Add(time.Second)), due.Add(24*time.Hour); !got.Equal(want) {
+		t.Errorf("nextDue() = %v, want %v", got, want)
+	}
+	// Days missed while suspended are coalesced
+	if got, want := p.nextDue(due, due.Add(50*time.Hour)), due.Add(72*time.Hour); !got.Equal(want) {
+		t.Errorf("nextDue() after suspend = %v, want %v", got, want)
+	}
+	if got := p.period(); got != 24*time.Hour {
+		t.Errorf("period() = %v, want 24h", got)
+	}
+}
@@ -0,0 +1,260 @@
+package parspackip
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// fetchers holds the fetcher of every distinct configuration in use, keyed
+// by its JSON encoding and reference-counted by the instances using it
+var fetchers = caddy.NewUsagePool()
+
+// fetcher is the pooled refresh loop of a configuration. src is the
+// instance that was provisioned first; it owns the loop and the fetched
+// ranges, and later instances read them through it.
+type fetcher struct {
+	src *ParspackIPRange
+
+	// members are the instances using the fetcher that haven't been
+	// cleaned up yet, in provisioning order. The last one provides the
+	// context, events app, transformers and logger used by the loop, so
+	// that they always belong to a running config rather than to src's,
+	// which may have been unloaded by a reload.
+	mu      sync.Mutex
+	members []*ParspackIPRange
+}
+
+// add records p as the most recently provisioned member of f
+func (f *fetcher) add(p *ParspackIPRange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members = append(f.members, p)
+}
+
+// remove forgets p once it is cleaned up
+func (f *fetcher) remove(p *ParspackIPRange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := slices.Index(f.members, p); i >= 0 {
+		f.members = slices.Delete(f.members, i, i+1)
+	}
+}
+
+// current returns the most recently provisioned member still in use, or
+// src once they are all gone
+func (f *fetcher) current() *ParspackIPRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n := len(f.members); n > 0 {
+		return f.members[n-1]
+	}
+	return f.src
+}
+
+// Destruct implements caddy.Destructor. It runs once the last instance
+// using the fetcher is cleaned up.
+func (f *fetcher) Destruct() error {
+	f.src.stop()
+	return nil
+}
+
+// join attaches p to the fetcher of its configuration, starting one if p is
+// the first instance with that configuration. Instances with identical
+// configuration, e.g. in several server blocks or in the previous and next
+// config during a reload, thus share a single fetcher instead of each
+// polling ParsPack.
+func (p *ParspackIPRange) join() error {
+	key, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	val, loaded, err := fetchers.LoadOrNew(string(key), func() (caddy.Destructor, error) {
+		f := &fetcher{src: p, members: []*ParspackIPRange{p}}
+		// Set before the loop starts, which reads it
+		p.pool = f
+		if err := p.start(); err != nil {
+			p.pool = nil
+			return nil, err
+		}
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+	p.poolKey = string(key)
+	if loaded {
+		f := val.(*fetcher)
+		f.add(p)
+		p.pool = f
+		p.shared = f.src
+	}
+	return nil
+}
+
+// leave detaches p from its fetcher, which then uses the config of the
+// previous member still in use
+func (p *ParspackIPRange) leave() {
+	if p.pool != nil {
+		p.pool.remove(p)
+	}
+}
+
+// current returns the instance whose context, events app, transformers
+// and logger the refresh loop of p uses: the most recently provisioned
+// instance sharing its fetcher, or p itself if it isn't shared
+func (p *ParspackIPRange) current() *ParspackIPRange {
+	if p.pool == nil {
+		return p
+	}
+	return p.pool.current()
+}
+
+// log returns the logger of p's current instance, so that a shared loop
+// logs through the log config of the most recent config rather than
+// through that of src, which may have been unloaded
+func (p *ParspackIPRange) log() *zap.Logger {
+	return p.current().logger
+}
+
+// source returns the instance holding the ranges served by p, which is p
+// itself unless it shares the fetcher of an earlier instance
+func (p *ParspackIPRange) source() *ParspackIPRange {
+	if p.shared != nil {
+		return p.shared
+	}
+	return p
+}
+
+// carried holds the result of the last successful fetch of every fetch
+// configuration, keyed by fetchKey. An instance whose configuration
+// differs from the previous one only in options that don't affect what is
+// fetched, e.g. after a reload changing the interval, starts from it
+// instead of fetching again. Entries are dropped once their reload window,
+// an interval after the fetch, has passed.
+var carried sync.Map
+
+// carriedState is the state taken over from a previous instance
+type carriedState struct {
+	fetched    []netip.Prefix
+	ipv6Ranges []netip.Prefix
+	sources    map[netip.Prefix]string
+	merged     map[string][]netip.Prefix
+	validators map[string]validators
+	pending    map[netip.Prefix]int
+	version    string
+	successes  int
+	lastFetch  time.Time
+	expires    time.Time
+}
+
+// fetchKey returns the key of the options that determine the fetched
+// ranges, or an empty string if the instance uses transformers passed in
+// from Go, which can't be compared
+func (p *ParspackIPRange) fetchKey() string {
+	if len(p.transformers) > len(p.TransformersRaw) {
+		return ""
+	}
+	key, err := json.Marshal(struct {
+		URL          string
+		Fallbacks    []string
+		Gzip         bool
+		Merge        []MergeSource
+		File         string
+		IPv6         bool
+		IPv6URL      string
+		ChecksumURL  string
+		Format       string
+		Strict       bool
+		MaxRanges    int
+		PrefixLens   [4]int
+		DropPrivate  bool
+		Method       string
+		Headers      http.Header
+		Transformers []json.RawMessage
+	}{p.URL, p.Fallbacks, p.Gzip, p.Merge, p.File, p.ipv6Enabled(), p.ipv6ListURL(), p.ChecksumURL, p.Format, p.Strict, p.MaxRanges, [4]int{p.MinPrefixLen, p.MaxPrefixLen, p.MinPrefixLenIPv6, p.MaxPrefixLenIPv6}, p.DropPrivate, p.method(), p.Headers, p.TransformersRaw})
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// saveCarriedLocked records the state of a successful fetch for later instances.
+// p.mu must be held.
+func (p *ParspackIPRange) saveCarriedLocked() {
+	if p.carryKey == "" {
+		return
+	}
+	carried.Store(p.carryKey, &carriedState{
+		fetched:    p.fetched,
+		ipv6Ranges: p.ipv6Ranges,
+		sources:    p.sources,
+		merged:     p.merged,
+		validators: maps.Clone(p.validators),
+		pending:    maps.Clone(p.pending),
+		version:    p.listVersion,
+		successes:  p.successes,
+		lastFetch:  p.lastFetch,
+		expires:    p.lastFetch.Add(p.period()),
+	})
+
+	// Drop the state of configs that are no longer reloaded into, so that
+	// each config change doesn't keep a range set for the process lifetime
+	now := p.now()
+	carried.Range(func(key, val any) bool {
+		if st := val.(*carriedState); !now.Before(st.expires) {
+			carried.CompareAndDelete(key, val)
+		}
+		return true
+	})
+}
+
+// loadCarried seeds p with the state of a previous instance with the same
+// fetchKey, if it fetched less than an interval ago. It reports whether
+// any state was taken over.
+func (p *ParspackIPRange) loadCarried() bool {
+	if p.carryKey == "" {
+		return false
+	}
+	val, ok := carried.Load(p.carryKey)
+	if !ok {
+		return false
+	}
+	st := val.(*carriedState)
+	if now := p.now(); !now.Before(st.expires) {
+		carried.CompareAndDelete(p.carryKey, val)
+		return false
+	} else if now.Sub(st.lastFetch) >= p.period() {
+		return false
+	}
+
+	p.mu.Lock()
+	p.fetched = st.fetched
+	p.ipv6Ranges = st.ipv6Ranges
+	p.sources = st.sources
+	p.merged = st.merged
+	p.validators = maps.Clone(st.validators)
+	p.pending = maps.Clone(st.pending)
+	p.listVersion = st.version
+	p.successes = st.successes
+	p.lastFetch = st.lastFetch
+	p.rebuildLocked()
+	p.mu.Unlock()
+
+	p.log().Info("reusing IP ranges fetched by the previous config",
+		zap.Int("count", len(st.fetched)),
+		zap.Time("last_fetch", st.lastFetch))
+	return true
+}
+
+// Interface guards
+var (
+	_ caddy.Destructor = (*fetcher)(nil)
+)
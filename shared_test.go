@@ -0,0 +1,188 @@
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSharedFetcher(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	newInstance := func() *ParspackIPRange {
+		p := newTestSource()
+		p.URL = srv.URL
+		p.Interval = caddy.Duration(time.Hour)
+		p.IPv6 = &disabled
+		// Fetch synchronously in join, with no refresh loop fetching on
+		// its own afterwards
+		p.WaitForFirstFetch = true
+		p.DisableRefresh = true
+		return p
+	}
+
+	first, second := newInstance(), newInstance()
+	if err := first.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	if err := second.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	if second.source() != first {
+		t.Error("instances with identical config should share a fetcher")
+	}
+	if got := len(second.GetIPRanges(nil)); got != 1 {
+		t.Errorf("got %d ranges through the shared fetcher, want 1", got)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+	second.Cleanup()
+	if first.current() != first {
+		t.Error("fetcher still bound to a cleaned up instance")
+	}
+	if err := second.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	// The loop uses the transformers, context, events app and logger of
+	// the most recent config, as the first one may be unloaded by a reload
+	if first.current() != second {
+		t.Error("fetcher not bound to the most recently joined instance")
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	second.logger = zap.New(core)
+	var transformed atomic.Int32
+	second.transformers = []Transformer{transformerFunc(func(ranges []netip.Prefix) ([]netip.Prefix, error) {
+		transformed.Add(1)
+		return ranges, nil
+	})}
+	if err := first.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	if transformed.Load() != 1 {
+		t.Error("the transformers of the most recent config were not run")
+	}
+	if logs.FilterMessage("successfully fetched IP ranges").Len() != 1 {
+		t.Error("the fetch was not logged through the logger of the most recent config")
+	}
+
+	other := newInstance()
+	other.Collapse = true
+	if err := other.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	if other.source() != other {
+		t.Error("instances with different config should not share a fetcher")
+	}
+	other.Cleanup()
+
+	// The fetcher lives on as long as an instance still uses it
+	first.Cleanup()
+	if first.loopCtx.Err() != nil {
+		t.Error("fetcher stopped while still in use")
+	}
+	if first.current() != second {
+		t.Error("fetcher not bound to the instance still in use")
+	}
+	second.Cleanup()
+	if first.loopCtx.Err() == nil {
+		t.Error("fetcher not stopped after its last user was cleaned up")
+	}
+	if _, ok := fetchers.References(first.poolKey); ok {
+		t.Error("fetcher still in the pool after its last user was cleaned up")
+	}
+}
+
+func TestCarriedOverRanges(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	newInstance := func() *ParspackIPRange {
+		p := newTestSource()
+		p.URL = srv.URL
+		p.Interval = caddy.Duration(time.Hour)
+		p.IPv6 = &disabled
+		p.WaitForFirstFetch = true
+		p.DisableRefresh = true
+		return p
+	}
+
+	old := newInstance()
+	if err := old.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	defer old.Cleanup()
+
+	// A reload changing an option that doesn't affect the fetched lists
+	// starts from the previous ranges
+	reloaded := newInstance()
+	reloaded.Jitter = caddy.Duration(time.Minute)
+	if err := reloaded.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	defer reloaded.Cleanup()
+	if reloaded.source() != reloaded {
+		t.Fatal("instances with different config should not share a fetcher")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+	if !reloaded.Ready() || len(reloaded.GetIPRanges(nil)) != 1 {
+		t.Errorf("carried over instance not ready: %+v", reloaded.status())
+	}
+
+	// A different list is fetched anew
+	strict := newInstance()
+	strict.Strict = true
+	if err := strict.join(); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+	defer strict.Cleanup()
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2 after changing how the list is parsed", got)
+	}
+}
+
+func TestCarriedExpires(t *testing.T) {
+	lastFetch := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	clk := newFakeClock(lastFetch.Add(2 * time.Hour))
+	carried.Store("expired-config", &carriedState{lastFetch: lastFetch, expires: lastFetch.Add(time.Hour)})
+	defer carried.Delete("expired-config")
+
+	// Saving the state of a running config drops the expired ones
+	p := newTestSource()
+	p.Interval = caddy.Duration(time.Hour)
+	p.clk = clk
+	p.carryKey = "running-config"
+	p.lastFetch = clk.Now()
+	defer carried.Delete(p.carryKey)
+	p.saveCarriedLocked()
+
+	if _, ok := carried.Load("expired-config"); ok {
+		t.Error("expired carried state kept")
+	}
+	if _, ok := carried.Load(p.carryKey); !ok {
+		t.Error("carried state of the running config dropped")
+	}
+}
@@ -0,0 +1,98 @@
+package parspackip
+
+import (
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// signalWatchers holds the fetchers refreshed on each RefreshSignal. A
+// single handler is installed per signal, however many fetchers use it,
+// and removed once the last of them stops.
+var signalWatchers = struct {
+	sync.Mutex
+	channels map[os.Signal]chan os.Signal
+	fetchers map[os.Signal][]*ParspackIPRange
+}{
+	channels: make(map[os.Signal]chan os.Signal),
+	fetchers: make(map[os.Signal][]*ParspackIPRange),
+}
+
+// parseSignal returns the signal named name, with or without the SIG
+// prefix, among the ones that can trigger a refresh
+func parseSignal(name string) (os.Signal, error) {
+	sig, ok := refreshSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, unsupportedSignalError(name)
+	}
+	return sig, nil
+}
+
+// watchSignal refreshes p whenever its refresh signal is received
+func (p *ParspackIPRange) watchSignal() {
+	if p.refreshSignal == nil {
+		return
+	}
+	signalWatchers.Lock()
+	defer signalWatchers.Unlock()
+
+	sig := p.refreshSignal
+	signalWatchers.fetchers[sig] = append(signalWatchers.fetchers[sig], p)
+	if _, ok := signalWatchers.channels[sig]; ok {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	signalWatchers.channels[sig] = ch
+	go handleSignal(sig, ch)
+}
+
+// unwatchSignal stops refreshing p on its refresh signal, removing the
+// handler if p was the last fetcher using it
+func (p *ParspackIPRange) unwatchSignal() {
+	if p.refreshSignal == nil {
+		return
+	}
+	signalWatchers.Lock()
+	defer signalWatchers.Unlock()
+
+	sig := p.refreshSignal
+	fetchers := slices.DeleteFunc(signalWatchers.fetchers[sig], func(w *ParspackIPRange) bool { return w == p })
+	if len(fetchers) > 0 {
+		signalWatchers.fetchers[sig] = fetchers
+		return
+	}
+	delete(signalWatchers.fetchers, sig)
+	if ch, ok := signalWatchers.channels[sig]; ok {
+		signal.Stop(ch)
+		close(ch)
+		delete(signalWatchers.channels, sig)
+	}
+}
+
+// handleSignal refreshes the fetchers watching sig each time it arrives on
+// ch, until ch is closed
+func handleSignal(sig os.Signal, ch chan os.Signal) {
+	for range ch {
+		signalWatchers.Lock()
+		fetchers := slices.Clone(signalWatchers.fetchers[sig])
+		signalWatchers.Unlock()
+
+		for _, p := range fetchers {
+			// Tracked like the refresh loop, so that a signal arriving during
+			// Cleanup can't start a fetch after it returned
+			started := p.goTracked(func() {
+				if err := p.refresh(p.loopCtx); err != nil {
+					p.log().Log(p.failureLevel(), "failed to refresh IP ranges", zap.Error(err))
+				}
+			})
+			if started {
+				p.log().Info("refreshing IP ranges on signal", zap.String("signal", sig.String()))
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package parspackip
+
+import (
+	"fmt"
+	"os"
+)
+
+// refreshSignals is empty, as there are no user signals on this platform
+var refreshSignals = map[string]os.Signal{}
+
+func unsupportedSignalError(string) error {
+	return fmt.Errorf("refresh_signal is not supported on this platform")
+}
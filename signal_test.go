@@ -0,0 +1,103 @@
+//go:build unix
+
+package parspackip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, name := range []string{"SIGHUP", "hup", "SIGUSR2"} {
+		if _, err := parseSignal(name); err != nil {
+			t.Errorf("parseSignal(%q) error = %v", name, err)
+		}
+	}
+	for _, name := range []string{"SIGTERM", "SIGKILL", "bogus"} {
+		if _, err := parseSignal(name); err == nil {
+			t.Errorf("parseSignal(%q) expected error", name)
+		}
+	}
+}
+
+func TestRefreshOnSignal(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	disabled := false
+	var sources [2]*ParspackIPRange
+	for i := range sources {
+		p := newTestSource()
+		p.URL = srv.URL
+		p.IPv6 = &disabled
+		p.refreshSignal = syscall.SIGUSR2
+		p.loopCtx = context.Background()
+		p.watchSignal()
+		sources[i] = p
+	}
+
+	signalWatchers.Lock()
+	handlers := len(signalWatchers.channels)
+	signalWatchers.Unlock()
+	if handlers != 1 {
+		t.Errorf("%d signal handlers installed, want 1", handlers)
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !sources[0].hasFetched() || !sources[1].hasFetched() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not every fetcher refreshed on the signal, %d requests", requests.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, p := range sources {
+		p.unwatchSignal()
+	}
+	signalWatchers.Lock()
+	handlers = len(signalWatchers.channels)
+	signalWatchers.Unlock()
+	if handlers != 0 {
+		t.Errorf("%d signal handlers left after the last fetcher stopped, want 0", handlers)
+	}
+}
+
+func TestRefreshOnSignalAfterStop(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("185.8.172.0/22\n"))
+	}))
+	defer srv.Close()
+
+	// A stopped fetcher still listed when the signal arrives, as during
+	// Cleanup, doesn't start a refresh
+	stopped := newTestSource()
+	stopped.URL = srv.URL
+	stopped.IPv6 = new(bool)
+	stopped.loopCtx = context.Background()
+	stopped.stop()
+	stopped.refreshSignal = syscall.SIGUSR2
+	stopped.watchSignal()
+	defer stopped.unwatchSignal()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := requests.Load(); got != 0 {
+		t.Errorf("got %d requests from a stopped fetcher, want 0", got)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package parspackip
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// refreshSignals are the signals RefreshSignal may name. Caddy itself
+// doesn't act on any of them.
+var refreshSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func unsupportedSignalError(name string) error {
+	return fmt.Errorf("unsupported refresh_signal %q: must be SIGHUP, SIGUSR1 or SIGUSR2", name)
+}
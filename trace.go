@@ -0,0 +1,116 @@
+package parspackip
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// fetchTrace records the phase timings and the size of a single list
+// request, to tell a slow server from a slow local network
+type fetchTrace struct {
+	mu                 sync.Mutex
+	start              time.Time
+	dnsStart, dnsDone  time.Time
+	connStart, connEnd time.Time
+	tlsStart, tlsDone  time.Time
+	firstByte, done    time.Time
+	reused             bool
+	bytes              int64
+}
+
+// newFetchTrace returns a trace for a request made now, or nil if Debug
+// logging is disabled and it wouldn't be logged anyway
+func (p *ParspackIPRange) newFetchTrace() *fetchTrace {
+	if !p.log().Core().Enabled(zapcore.DebugLevel) {
+		return nil
+	}
+	return &fetchTrace{start: time.Now()}
+}
+
+// clientTrace returns the hooks recording the timings of the request
+func (t *fetchTrace) clientTrace() *httptrace.ClientTrace {
+	record := func(at *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		*at = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { record(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { record(&t.dnsDone) },
+		ConnectStart:         func(string, string) { record(&t.connStart) },
+		ConnectDone:          func(string, string, error) { record(&t.connEnd) },
+		TLSHandshakeStart:    func() { record(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&t.tlsDone) },
+		GotFirstResponseByte: func() { record(&t.firstByte) },
+	}
+}
+
+// countBody wraps body to count the bytes downloaded and note when the
+// download ended
+func (t *fetchTrace) countBody(body io.ReadCloser) io.ReadCloser {
+	return &countingBody{ReadCloser: body, trace: t}
+}
+
+// log logs the timings and size of the request at Debug level. Phases
+// that didn't happen, like DNS and connecting on a reused connection, are
+// left out.
+func (t *fetchTrace) log(logger *zap.Logger, rawURL string, resp *http.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	end := t.done
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	fields := []zap.Field{
+		zap.String("url", rawURL),
+		zap.Int("status", resp.StatusCode),
+		zap.String("protocol", resp.Proto),
+		zap.Int64("bytes", t.bytes),
+		zap.Bool("reused_connection", t.reused),
+	}
+	for _, phase := range []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"dns", t.dnsStart, t.dnsDone},
+		{"connect", t.connStart, t.connEnd},
+		{"tls_handshake", t.tlsStart, t.tlsDone},
+		{"first_byte", t.start, t.firstByte},
+	} {
+		if !phase.start.IsZero() && !phase.end.IsZero() {
+			fields = append(fields, zap.Duration(phase.name, phase.end.Sub(phase.start)))
+		}
+	}
+	fields = append(fields, zap.Duration("total", end.Sub(t.start)))
+	logger.Debug("fetched IP list", fields...)
+}
+
+// countingBody is a response body counting the bytes read from it
+type countingBody struct {
+	io.ReadCloser
+	trace *fetchTrace
+}
+
+func (b *countingBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	b.trace.mu.Lock()
+	b.trace.bytes += int64(n)
+	if err == io.EOF {
+		b.trace.done = time.Now()
+	}
+	b.trace.mu.Unlock()
+	return n, err
+}
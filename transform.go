@@ -0,0 +1,84 @@
+package parspackip
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Transformer post-processes the ranges of every successful fetch, e.g. to
+// map them through a NAT translation or filter them by region. It runs
+// before the additional and excluded ranges are applied, and an error
+// rejects the fetch, keeping the previous ranges.
+//
+// Transformers can be passed in from Go with WithTransformer, or
+// registered as Caddy modules in the http.ip_sources.parspack.transformers
+// namespace and selected by name in the config. When a fetcher is shared
+// with a later config during a reload, the transformers loaded by the
+// most recent config still in use are the ones run.
+type Transformer interface {
+	Transform([]netip.Prefix) ([]netip.Prefix, error)
+}
+
+// transformersNamespace is the Caddy module namespace of transformers
+const transformersNamespace = "http.ip_sources.parspack.transformers"
+
+// transformedSource is the source tag of ranges added by a transformer
+const transformedSource = "transformed"
+
+// loadTransformers loads the transformer modules configured in
+// TransformersRaw and appends them to the transformers passed in from Go
+func (p *ParspackIPRange) loadTransformers(ctx caddy.Context) error {
+	if p.TransformersRaw == nil {
+		return nil
+	}
+
+	// LoadModule clears the raw config, which is part of the key of the
+	// shared fetcher
+	raw := p.TransformersRaw
+	mods, err := ctx.LoadModule(p, "TransformersRaw")
+	p.TransformersRaw = raw
+	if err != nil {
+		return fmt.Errorf("loading transformers: %v", err)
+	}
+
+	for _, mod := range mods.([]any) {
+		t, ok := mod.(Transformer)
+		if !ok {
+			return fmt.Errorf("module %T is not a parspack transformer", mod)
+		}
+		p.transformers = append(p.transformers, t)
+	}
+	return nil
+}
+
+// transform runs ranges through every transformer in order. sources is
+// updated to the transformed ranges, with ranges that weren't fetched
+// tagged as transformed.
+func (p *ParspackIPRange) transform(ranges []netip.Prefix, sources map[netip.Prefix]string) ([]netip.Prefix, map[netip.Prefix]string, error) {
+	transformers := p.current().transformers
+	if len(transformers) == 0 {
+		return ranges, sources, nil
+	}
+
+	for _, t := range transformers {
+		var err error
+		if ranges, err = t.Transform(ranges); err != nil {
+			return nil, nil, fmt.Errorf("transformer %T: %w", t, err)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, nil, fmt.Errorf("transformers returned no ranges, keeping previous ranges: %w", ErrEmptyList)
+	}
+
+	tagged := make(map[netip.Prefix]string, len(ranges))
+	for _, prefix := range ranges {
+		if source, ok := sources[prefix]; ok {
+			tagged[prefix] = source
+		} else {
+			tagged[prefix] = transformedSource
+		}
+	}
+	return ranges, tagged, nil
+}
@@ -0,0 +1,131 @@
+package parspackip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(ipv4OnlyTransformer{})
+}
+
+// ipv4OnlyTransformer is a transformer module dropping IPv6 ranges
+type ipv4OnlyTransformer struct{}
+
+func (ipv4OnlyTransformer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  transformersNamespace + ".test_ipv4_only",
+		New: func() caddy.Module { return new(ipv4OnlyTransformer) },
+	}
+}
+
+func (ipv4OnlyTransformer) Transform(ranges []netip.Prefix) ([]netip.Prefix, error) {
+	return slices.DeleteFunc(ranges, func(prefix netip.Prefix) bool { return prefix.Addr().Is6() }), nil
+}
+
+func (ipv4OnlyTransformer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	return nil
+}
+
+// transformerFunc adapts a function to the Transformer interface
+type transformerFunc func([]netip.Prefix) ([]netip.Prefix, error)
+
+func (f transformerFunc) Transform(ranges []netip.Prefix) ([]netip.Prefix, error) {
+	return f(ranges)
+}
+
+func TestTransform(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("185.8.172.0/22\n195.248.240.0/22\n"))
+	}))
+	defer srv.Close()
+
+	// Translate 185.8.172.0/22 to an internal range
+	var failing bool
+	disabled := false
+	p := newTestSource()
+	WithTransformer(transformerFunc(func(ranges []netip.Prefix) ([]netip.Prefix, error) {
+		if failing {
+			return nil, errors.New("boom")
+		}
+		for i, prefix := range ranges {
+			if prefix == netip.MustParsePrefix("185.8.172.0/22") {
+				ranges[i] = netip.MustParsePrefix("10.8.172.0/22")
+			}
+		}
+		return ranges, nil
+	}))(p)
+	p.URL = srv.URL
+	p.IPv6 = &disabled
+
+	if err := p.fetchIPRanges(context.Background()); err != nil {
+		t.Fatalf("fetchIPRanges() error = %v", err)
+	}
+	want := prefixes("10.8.172.0/22", "195.248.240.0/22")
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() = %v, want %v", got, want)
+	}
+	if got := p.status().Sources["10.8.172.0/22"]; got != transformedSource {
+		t.Errorf("source of the translated range = %q, want %q", got, transformedSource)
+	}
+
+	failing = true
+	if err := p.fetchIPRanges(context.Background()); err == nil {
+		t.Error("expected the transformer error to fail the fetch")
+	}
+	if got := p.GetIPRanges(nil); !slices.Equal(got, want) {
+		t.Errorf("GetIPRanges() after failed transform = %v, want previous %v", got, want)
+	}
+}
+
+func TestLoadTransformers(t *testing.T) {
+	if reflect.TypeFor[json.RawMessage]().PkgPath() != "encoding/json" {
+		t.Skip("Caddy can't load modules from []json.RawMessage when it is an alias of jsontext.Value")
+	}
+
+	d := caddyfile.NewTestDispenser(`parspack {
+		transform test_ipv4_only
+	}`)
+	p := new(ParspackIPRange)
+	if err := p.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile() error = %v", err)
+	}
+	if len(p.TransformersRaw) != 1 {
+		t.Fatalf("got %d transformers, want 1", len(p.TransformersRaw))
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := p.loadTransformers(ctx); err != nil {
+		t.Fatalf("loadTransformers() error = %v", err)
+	}
+	if len(p.transformers) != 1 {
+		t.Fatalf("loaded %d transformers, want 1", len(p.transformers))
+	}
+	if p.TransformersRaw == nil {
+		t.Error("raw transformer config was cleared, the shared fetcher key depends on it")
+	}
+
+	got, err := p.transformers[0].Transform(prefixes("185.8.172.0/22", "2a0e:1c80::/32"))
+	if err != nil || !slices.Equal(got, prefixes("185.8.172.0/22")) {
+		t.Errorf("Transform() = %v, %v", got, err)
+	}
+
+	d = caddyfile.NewTestDispenser(`parspack {
+		transform unknown
+	}`)
+	if err := new(ParspackIPRange).UnmarshalCaddyfile(d); err == nil {
+		t.Error("expected error for an unknown transformer")
+	}
+}
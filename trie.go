@@ -0,0 +1,128 @@
+package parspackip
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// trie is a path-compressed binary trie over IP prefixes. IPv4 prefixes are
+// stored as IPv4-mapped IPv6 ones, in a separate root so that an IPv6
+// address never matches them. A lookup visits at most one node per branch
+// point on its path, and compares addresses as two machine words.
+type trie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	key      uint128
+	bits     int
+	terminal bool
+	children [2]*trieNode
+}
+
+// uint128 is a 128-bit address, most significant word first
+type uint128 struct {
+	hi, lo uint64
+}
+
+func toUint128(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+// mask returns u with all but its n most significant bits cleared
+func (u uint128) mask(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{u.hi &^ (^uint64(0) >> n), 0}
+	case n < 128:
+		return uint128{u.hi, u.lo &^ (^uint64(0) >> (n - 64))}
+	}
+	return u
+}
+
+// bit returns bit i of u, counting from the most significant bit
+func (u uint128) bit(i int) int {
+	if i < 64 {
+		return int(u.hi>>(63-i)) & 1
+	}
+	return int(u.lo>>(127-i)) & 1
+}
+
+// commonBits returns the number of leading bits u and v have in common
+func (u uint128) commonBits(v uint128) int {
+	if x := u.hi ^ v.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(u.lo^v.lo)
+}
+
+// newTrie builds a trie containing ranges
+func newTrie(ranges []netip.Prefix) *trie {
+	t := new(trie)
+	for _, prefix := range ranges {
+		root, n := &t.v6, prefix.Bits()
+		if prefix.Addr().Is4() {
+			root, n = &t.v4, n+96
+		}
+		key := toUint128(prefix.Addr()).mask(n)
+		trieInsert(root, key, n)
+	}
+	return t
+}
+
+// contains reports whether addr falls within one of the prefixes of t
+func (t *trie) contains(addr netip.Addr) bool {
+	n := t.v6
+	if addr.Is4() {
+		n = t.v4
+	}
+	key := toUint128(addr)
+	for n != nil {
+		if key.mask(n.bits) != n.key {
+			return false
+		}
+		if n.terminal {
+			return true
+		}
+		n = n.children[key.bit(n.bits)]
+	}
+	return false
+}
+
+// trieInsert adds the prefix key/bits to the subtree rooted at *n
+func trieInsert(n **trieNode, key uint128, bits int) {
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &trieNode{key: key, bits: bits, terminal: true}
+			return
+		}
+
+		// The new prefix lies below cur, descend
+		if cur.bits <= bits && key.mask(cur.bits) == cur.key {
+			if cur.bits == bits {
+				cur.terminal = true
+				return
+			}
+			n = &cur.children[key.bit(cur.bits)]
+			continue
+		}
+
+		// The new prefix contains cur, or they diverge and need a branch
+		// node at their longest common prefix
+		common := min(key.commonBits(cur.key), bits, cur.bits)
+		parent := &trieNode{key: key.mask(common), bits: common}
+		if common == bits {
+			parent.terminal = true
+		} else {
+			parent.children[key.bit(common)] = &trieNode{key: key, bits: bits, terminal: true}
+		}
+		parent.children[cur.key.bit(common)] = cur
+		*n = parent
+		return
+	}
+}
@@ -0,0 +1,100 @@
+package parspackip
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	ranges := prefixes("185.8.172.0/22", "185.8.173.0/24", "10.0.0.0/8", "10.1.2.3/32", "195.248.240.0/22", "2a0e:1c80::/32", "2001:db8:1::/48")
+	tr := newTrie(ranges)
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"185.8.172.1", true},
+		{"185.8.175.255", true},
+		{"185.8.176.0", false},
+		{"10.200.0.1", true},
+		{"11.0.0.0", false},
+		{"195.248.243.10", true},
+		{"195.248.244.0", false},
+		{"2a0e:1c80:ffff::1", true},
+		{"2a0e:1c81::1", false},
+		{"2001:db8:1:2::1", true},
+		{"2001:db8:2::1", false},
+		{"::ffff:185.8.172.1", false},
+	}
+	for _, tt := range tests {
+		if got := tr.contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if newTrie(nil).contains(netip.MustParseAddr("185.8.172.1")) {
+		t.Error("empty trie should contain nothing")
+	}
+}
+
+func TestTrieMatchesBinarySearch(t *testing.T) {
+	ranges := randomRanges(rand.New(rand.NewPCG(1, 2)), 2000)
+	lookup := normalizeRanges(ranges, true)
+	tr := newTrie(ranges)
+
+	r := rand.New(rand.NewPCG(3, 4))
+	for range 20000 {
+		addr := netip.AddrFrom4([4]byte{byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256)), byte(r.IntN(256))})
+		if got, want := tr.contains(addr), containsSorted(lookup, addr); got != want {
+			t.Fatalf("contains(%s) = %v, binary search says %v", addr, got, want)
+		}
+	}
+}
+
+func TestContainsLargeList(t *testing.T) {
+	p := &ParspackIPRange{Collapse: true}
+	for i := range trieThreshold {
+		p.fetched = append(p.fetched, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 6), byte(i << 2), 0}), 24))
+	}
+	p.rebuildLocked()
+	if p.trie == nil {
+		t.Fatalf("expected a trie for %d ranges", len(p.lookup))
+	}
+	if !p.Contains(netip.MustParseAddr("10.0.0.1")) || p.Contains(netip.MustParseAddr("10.0.1.1")) {
+		t.Error("Contains() through the trie gave a wrong answer")
+	}
+}
+
+// randomRanges returns n random IPv4 prefixes within 0.0.0.0/6, so that a
+// good share of them overlap
+func randomRanges(r *rand.Rand, n int) []netip.Prefix {
+	ranges := make([]netip.Prefix, n)
+	for i := range ranges {
+		addr := netip.AddrFrom4([4]byte{byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256)), 0})
+		ranges[i] = netip.PrefixFrom(addr, 8+r.IntN(17)).Masked()
+	}
+	return ranges
+}
+
+func BenchmarkContains(b *testing.B) {
+	ranges := randomRanges(rand.New(rand.NewPCG(1, 2)), 50000)
+	lookup := normalizeRanges(ranges, true)
+	tr := newTrie(ranges)
+	addrs := make([]netip.Addr, 1024)
+	r := rand.New(rand.NewPCG(3, 4))
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{byte(r.IntN(8)), byte(r.IntN(256)), byte(r.IntN(256)), byte(r.IntN(256))})
+	}
+
+	b.Run("binary search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			containsSorted(lookup, addrs[i%len(addrs)])
+		}
+	})
+	b.Run("trie", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.contains(addrs[i%len(addrs)])
+		}
+	})
+}